@@ -5,20 +5,113 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	// gitlab apis
+	"github.com/sanitizer/discovery/interface"
 	"github.com/sanitizer/discovery/security"
 	"github.com/sanitizer/discovery/utils"
 	"github.com/sanitizer/discovery/model"
 )
 
+// number of addresses of the other ip family sent along with AppIp when AppIps is not set
+const MAX_LOCAL_APP_IPS = 4
+
+/*
+	Security holds the pre-shared key, it has to be the same as the one used by
+	the DiscoveryAgent and by all the other agents that should be discoverable.
+	if Security is not set, a security with the library default key is used.
+	sharing one keyring with the agent keeps key rotation in sync, see security.Keyring.
+	sealed packages with a timestamp further than MaxClockSkew from local time
+	(default security.DEFAULT_MAX_CLOCK_SKEW) or with a nonce that is already in
+	ReplayCache are dropped. if ReplayCache is not set, discovery server and Discover give
+	handler a cache of its own, see dminterface.ReplayProtectedHandler. handler used on
+	its own without ReplayCache checks timestamps only.
+	Payload is a custom value sent along with discovery responses, it is marshaled
+	using PayloadCodec. received payloads are unmarshaled into PayloadCodec.NewPayload()
+	and set on DiscoveredTarget.Payload. if PayloadCodec is not set, payload is sent
+	using gob and received payload is set on the target as raw []byte.
+	Attributes are key/value pairs describing the app, e.g. version=2 or env=staging,
+	they are sent with discovery responses and set on DiscoveredTarget.Attributes.
+	payload and attributes together have to fit into discomodel.DISCOVERY_PKG_BUDGET.
+	payloads and attributes are not supported in legacy cfb mode.
+	ServiceType (e.g. "_billing._tcp") and InstanceName (default is hostname) describe
+	the app, handler answers only requests whose service filter matches them.
+	in legacy cfb mode every request is answered.
+	AppPort may be left empty when the app exposes its ports through Services. requests
+	are answered with one record per matching service, records that do not fit into one
+	datagram are split across several.
+	AppIp is used for services without ip. Services are not supported in legacy cfb mode.
+	AppIps are further addresses of the app, e.g. the ipv6 address of a dual-stack host
+	next to the ipv4 AppIp, receivers get all of them in DiscoveredTarget.Ips. if AppIps is not set
+	and AppIp is an address of this host, up to MAX_LOCAL_APP_IPS addresses of the other ip family
+	on the interface holding AppIp are sent, see utils.GetOtherFamilyIps. zones of link local
+	addresses are not sent, receivers set the zone of the interface the package came in on.
+	announcements and goodbyes of other agents are handled like responses, targets
+	from goodbyes have discomodel.TARGET_STATUS_LEFT status, all the others
+	discomodel.TARGET_STATUS_DISCOVERED.
+	InstanceId is the stable id of this agent sent with its services and set on
+	DiscoveredTarget.Id by receivers. if not set, an id persisted in DefaultInstanceIdPath is used,
+	every combination of AppPort, ServiceType and InstanceName has an id of its own. set InstanceId
+	when several handlers exposing their ports only through Services run on one host.
+	Ttl is how long receivers keep the targets of this handler without hearing from it
+	again (default discomodel.DEFAULT_TTL), it is sent in whole seconds and should be
+	a few times longer than the announce interval of the agent
+	requests are answered by dialing RequesterIp and RequesterPort of the request. requests
+	with ReplyToSource received through ReceiveDataFromPacketConnection are answered from
+	the same connection to the source address of the request instead, which works behind nat
+	and can not be pointed at a third party. requesters set ReplyToSource only when they read
+	replies from the socket they sent the request from, see discomodel.DiscoveryPkg.
+	handler waits a random time up to MaxJitter of the request before answering, and leaves
+	out services the request lists as known answers, see discomodel.KnownAnswer
+*/
 type DefaultDiscoveryHandler struct{
 	AppIp               string
+	AppIps              []string
 	AppPort             string
 	DiscoveredTargets   chan discomodel.DiscoveredTarget
+	Security            *security.Security
+	MaxClockSkew        time.Duration
+	ReplayCache         *security.NonceCache
+	Payload             interface{}
+	PayloadCodec        dminterface.PayloadCodec
+	Attributes          map[string]string
+	ServiceType         string
+	InstanceName        string
+	Services            *ServiceSet
+	Ttl                 time.Duration
+	InstanceId          string
+}
+
+// connection and address a request was received from, the reply is sent back there
+type requestSource struct {
+	connection net.PacketConn
+	address    net.Addr
+}
+
+// zone of the interface the package came in on, empty when it is not known
+// link local addresses received without zone are only reachable through that interface
+func (this *requestSource) zone() string {
+	if this == nil {
+		return ""
+	}
+
+	if address, ok := this.address.(*net.UDPAddr); ok {
+		return address.Zone
+	}
+	return ""
+}
+
+// returns security that was set on handler or the default one
+func (this *DefaultDiscoveryHandler) getSecurity() *security.Security {
+	if this.Security == nil {
+		return new(security.Security)
+	}
+	return this.Security
 }
 
 func (this *DefaultDiscoveryHandler) String() string {
@@ -43,27 +136,325 @@ func (this *DefaultDiscoveryHandler) handleMissingAppIp() error {
 	return nil
 }
 
+// sealed discovery packages are sent as their raw envelope frame, anything else is sent using gob
 func (this DefaultDiscoveryHandler) SendDataToConnection(connection net.Conn, data interface{}) error {
+	datagram, e := encodeDiscoveryData(data)
+	if e != nil {
+		return e
+	}
+
 	// Will write to network.
-	enc := gob.NewEncoder(connection)
-	return enc.Encode(data)
+	_, e = connection.Write(datagram)
+	return e
+}
+
+// same as SendDataToConnection, for a connection that is not connected to address
+func (this DefaultDiscoveryHandler) SendDataTo(connection net.PacketConn, address net.Addr, data interface{}) error {
+	datagram, e := encodeDiscoveryData(data)
+	if e != nil {
+		return e
+	}
+
+	// Will write to network.
+	_, e = connection.WriteTo(datagram, address)
+	return e
+}
+
+// returns the single datagram data is sent in
+func encodeDiscoveryData(data interface{}) ([]byte, error) {
+	if sealed := sealedEnvelope(data); sealed != nil {
+		return sealed, nil
+	}
+
+	// gob writes type info and value as separate messages, so the whole stream is
+	// buffered first and sent as a single datagram. otherwise replies of several
+	// responders arriving at the same time would interleave on the requester side
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	e := enc.Encode(data)
+	if e != nil {
+		return nil, e
+	}
+	return buffer.Bytes(), nil
 }
 
 // receive data from connection using gob
+// the received package is handled in a separate goroutine
 func (this DefaultDiscoveryHandler) ReceiveDataFromConnection(connection net.Conn) error {
+	newInstance, e := this.receiveDiscoveryPkg(connection)
+	if e != nil {
+		return e
+	}
+	go this.handleDiscoveryData(newInstance, nil)
+	return nil
+}
+
+// receive data from connection using gob and handle it before returning
+// useful when the caller needs to know that all the received data was processed
+// before closing the connection or DiscoveredTargets channel
+func (this DefaultDiscoveryHandler) HandleDataFromConnection(connection net.Conn) error {
+	newInstance, e := this.receiveDiscoveryPkg(connection)
+	if e != nil {
+		return e
+	}
+	this.handleDiscoveryData(newInstance, nil)
+	return nil
+}
+
+// same as ReceiveDataFromConnection, requests are answered to the address they came from
+func (this DefaultDiscoveryHandler) ReceiveDataFromPacketConnection(connection net.PacketConn) error {
+	newInstance, source, e := this.receiveDiscoveryPkgFrom(connection)
+	if e != nil {
+		return e
+	}
+	go this.handleDiscoveryData(newInstance, source)
+	return nil
+}
+
+// same as HandleDataFromConnection, requests are answered to the address they came from
+func (this DefaultDiscoveryHandler) HandleDataFromPacketConnection(connection net.PacketConn) error {
+	newInstance, source, e := this.receiveDiscoveryPkgFrom(connection)
+	if e != nil {
+		return e
+	}
+	this.handleDiscoveryData(newInstance, source)
+	return nil
+}
+
+// returns envelope frame of a sealed discovery package or nil for any other data
+func sealedEnvelope(data interface{}) []byte {
+	switch pkg := data.(type) {
+	case discomodel.DiscoveryPkg:
+		return pkg.Sealed
+	case *discomodel.DiscoveryPkg:
+		if pkg != nil {
+			return pkg.Sealed
+		}
+	}
+	return nil
+}
+
+// reads a single datagram from connection and decodes it into DiscoveryPkg
+// package is nil when datagram is only the beginning of a legacy gob stream
+func (this DefaultDiscoveryHandler) receiveDiscoveryPkg(connection net.Conn) (*discomodel.DiscoveryPkg, error) {
+	if packetConnection, ok := connection.(net.PacketConn); ok {
+		newInstance, _, e := this.receiveDiscoveryPkgFrom(packetConnection)
+		return newInstance, e
+	}
+
+	buffer := make([]byte, discomodel.MAX_DATAGRAM_SIZE)
+	// Will read from network.
+	n, e := connection.Read(buffer)
+	return this.decodeDiscoveryPkg(buffer[:n], streamSource(connection.LocalAddr(), connection.RemoteAddr()), e)
+}
+
+// same as receiveDiscoveryPkg, also returns where the datagram came from
+func (this DefaultDiscoveryHandler) receiveDiscoveryPkgFrom(connection net.PacketConn) (*discomodel.DiscoveryPkg, *requestSource, error) {
+	buffer := make([]byte, discomodel.MAX_DATAGRAM_SIZE)
+	// Will read from network.
+	n, address, e := connection.ReadFrom(buffer)
+	newInstance, e := this.decodeDiscoveryPkg(buffer[:n], streamSource(connection.LocalAddr(), address), e)
+	if e != nil {
+		return nil, nil, e
+	}
+	return newInstance, &requestSource{connection: connection, address: address}, nil
+}
+
+// decodes datagram read from source with error e into DiscoveryPkg
+// in legacy cfb mode datagram holds a gob stream or a part of it, see legacyStreams,
+// otherwise it is the sealed envelope frame
+func (this DefaultDiscoveryHandler) decodeDiscoveryPkg(datagram []byte, source string, e error) (*discomodel.DiscoveryPkg, error) {
 	newInstance := new(discomodel.DiscoveryPkg)
-	// Will read from buffer
-	decoder := gob.NewDecoder(connection)
-	// Decode (receive) the value.
-	e := decoder.Decode(newInstance)
+	if e == nil && this.getSecurity().LegacyCFB {
+		// Decode (receive) the value.
+		var complete bool
+		complete, e = defaultLegacyStreams.decode(source, datagram, newInstance)
+		if e == nil && !complete {
+			return nil, nil
+		}
+	} else if e == nil {
+		newInstance.Sealed = datagram
+	}
+
 	if e != nil && !strings.Contains(e.Error(), "timeout") {
 		fmt.Println("Error receiving discovery data. " + e.Error())
-		return e
+		return nil, e
 	} else if e != nil {
 		fmt.Println("Planned server timeout: " + e.Error())
+		return nil, e
+	}
+	return newInstance, nil
+}
+
+// key of the sender of a datagram, nil addresses are fine for in-memory connections
+func streamSource(local net.Addr, remote net.Addr) string {
+	var strBldr bytes.Buffer
+	if local != nil {
+		strBldr.WriteString(local.String())
+	}
+	strBldr.WriteString(">")
+	if remote != nil {
+		strBldr.WriteString(remote.String())
+	}
+	return strBldr.String()
+}
+
+// returns instance name that was set on handler or the hostname
+func (this *DefaultDiscoveryHandler) getInstanceName() (string, error) {
+	if this.InstanceName != "" {
+		return this.InstanceName, nil
+	}
+	return os.Hostname()
+}
+
+/*
+ returns AppIps that were set on handler, or the other family addresses of the interface holding AppIp.
+ addresses are looked up every time, so a changed address of the host is announced right away
+*/
+func (this *DefaultDiscoveryHandler) getAppIps() []string {
+	if len(this.AppIps) > 0 {
+		return this.AppIps
+	}
+
+	result, e := utils.GetOtherFamilyIps(this.AppIp, MAX_LOCAL_APP_IPS)
+	if e != nil || len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// returns record with zones left out of all its addresses, they mean nothing on other hosts
+func withoutZones(record discomodel.ServiceRecord) discomodel.ServiceRecord {
+	record.Ip = utils.StripZone(record.Ip)
+	if len(record.Ips) > 0 {
+		ips := make([]string, 0, len(record.Ips))
+		for _, ip := range record.Ips {
+			ips = append(ips, utils.StripZone(ip))
+		}
+		record.Ips = ips
+	}
+	return record
+}
+
+// returns record of the service described by App* attrs of handler
+func (this *DefaultDiscoveryHandler) defaultServiceRecord(appIp string, appPort string) (discomodel.ServiceRecord, error) {
+	instanceName, e := this.getInstanceName()
+	if e != nil {
+		return discomodel.ServiceRecord{}, errors.New("Error getting instance name: " + e.Error())
+	}
+
+	return discomodel.ServiceRecord{ServiceType: this.ServiceType,
+		InstanceName: instanceName,
+		Ip:           appIp,
+		Port:         appPort,
+		Ips:          this.getAppIps(),
+		Attributes:   this.Attributes}, nil
+}
+
+// returns records of all the services of handler matching filter
+// the default service is included only if AppPort was set
+func (this *DefaultDiscoveryHandler) serviceRecords(filter discomodel.ServiceFilter) ([]discomodel.ServiceRecord, error) {
+	result := make([]discomodel.ServiceRecord, 0)
+
+	if this.AppPort != "" {
+		record, e := this.defaultServiceRecord(this.AppIp, this.AppPort)
+		if e != nil {
+			return nil, e
+		}
+
+		if filter.Matches(record.ServiceType, record.InstanceName) {
+			result = append(result, withoutZones(record))
+		}
+	}
+
+	appIps := this.getAppIps()
+	for _, record := range this.Services.Matching(filter) {
+		if record.Ip == "" {
+			record.Ip = this.AppIp
+			record.Ips = appIps
+		}
+		result = append(result, withoutZones(record))
+	}
+
+	return result, nil
+}
+
+// returns payload codec that was set on handler or the gob one
+func (this *DefaultDiscoveryHandler) getPayloadCodec() dminterface.PayloadCodec {
+	if this.PayloadCodec == nil {
+		return GobPayloadCodec{}
+	}
+	return this.PayloadCodec
+}
+
+// marshals Payload of handler, nil if handler has no payload
+func (this *DefaultDiscoveryHandler) marshalPayload() ([]byte, error) {
+	if this.Payload == nil {
+		return nil, nil
+	}
+	return this.getPayloadCodec().Marshal(this.Payload)
+}
+
+// unmarshals received payload into a new instance of the registered model
+// without registered codec raw payload is returned
+func (this *DefaultDiscoveryHandler) unmarshalPayload(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if this.PayloadCodec == nil {
+		return data, nil
+	}
+
+	payload := this.PayloadCodec.NewPayload()
+	if e := this.PayloadCodec.Unmarshal(data, payload); e != nil {
+		return nil, errors.New("Error unmarshaling payload: " + e.Error())
+	}
+	return payload, nil
+}
+
+// returns instance id of handler or the persisted default one
+func (this *DefaultDiscoveryHandler) getInstanceId() string {
+	if this.InstanceId != "" {
+		return this.InstanceId
+	}
+	return getDefaultInstanceId(instanceIdKey(this.AppPort, this.ServiceType, this.InstanceName))
+}
+
+// returns ttl of handler or discomodel.DEFAULT_TTL, never less than a second
+func (this *DefaultDiscoveryHandler) getTtl() time.Duration {
+	if this.Ttl <= 0 {
+		return discomodel.DEFAULT_TTL
+	} else if this.Ttl < time.Second {
+		return time.Second
+	}
+	return this.Ttl
+}
+
+// see dminterface.ReplayProtectedHandler
+func (this DefaultDiscoveryHandler) HasReplayCache() bool {
+	return this.ReplayCache != nil
+}
+
+// see dminterface.ReplayProtectedHandler
+func (this *DefaultDiscoveryHandler) SetReplayCache(cache *security.NonceCache) {
+	this.ReplayCache = cache
+}
+
+// drops packages that are too old, from the future or were already received
+// timestamp is checked first, so stale packages do not push valid nonces out of the cache
+func (this *DefaultDiscoveryHandler) handleReplayedPkg(receivedData *discomodel.DiscoveryPkg) error {
+	e := security.CheckTimestamp(receivedData.Timestamp, time.Now(), this.MaxClockSkew)
+	if e != nil {
 		return e
-	} else {
-		go this.handleDiscoveryData(newInstance)
+	}
+
+	if receivedData.Nonce == "" {
+		return errors.New("Error: package has no nonce")
+	}
+
+	if this.ReplayCache != nil && !this.ReplayCache.Remember(receivedData.Nonce) {
+		return errors.New("Error: package with nonce " + receivedData.Nonce + " was already received")
 	}
 	return nil
 }
@@ -90,9 +481,10 @@ func (this *DefaultDiscoveryHandler) handleDiscoveryHandlerStruct() error {
 }
 
 // logic around handling data received from udpconnection
-func (this DefaultDiscoveryHandler) handleDiscoveryData(instance *discomodel.DiscoveryPkg) {
+// source is nil when it is not known where the data came from
+func (this DefaultDiscoveryHandler) handleDiscoveryData(instance *discomodel.DiscoveryPkg, source *requestSource) {
 	if instance != nil {
-		e1 := this.handleDiscoveryRequest(instance)
+		e1 := this.handleDiscoveryRequest(instance, source)
 
 		if e1 != nil {
 			fmt.Println("Error handling discovery data. " + e1.Error())
@@ -102,12 +494,11 @@ func (this DefaultDiscoveryHandler) handleDiscoveryData(instance *discomodel.Dis
 
 // this method will decrypt data that was received from connection
 // the method relies on DiscoveryPkg model
-func decryptDiscoveryPkg(data *discomodel.DiscoveryPkg) error {
+func decryptDiscoveryPkg(data *discomodel.DiscoveryPkg, s *security.Security) error {
 	/*
 		the reason to do all the below operations is that the length of
 		original data inserted into the encrypted data
 	*/
-	s := new(security.Security)
 	decrSerPort, e1 := decryptCFBString(data.AppServerPort, s)
 	decrLocAppServerIp, e2 := decryptCFBString(data.AppServerIp, s)
 	decrPkgVal, e3 := decryptCFBString(data.PkgValidation, s)
@@ -164,20 +555,26 @@ func decryptDiscoveryPkg(data *discomodel.DiscoveryPkg) error {
  check if the discovery request is a loopback
  if all checks passed, send discovery response
 */
-func (this DefaultDiscoveryHandler) handleDiscoveryRequest(receivedData *discomodel.DiscoveryPkg) error {
+func (this DefaultDiscoveryHandler) handleDiscoveryRequest(receivedData *discomodel.DiscoveryPkg, source *requestSource) error {
 
-	decrErr := decryptDiscoveryPkg(receivedData)
+	s := this.getSecurity()
+	var decrErr error
+	// sealed packages are rejected as a whole if anything was changed on the way,
+	// so no field is trusted before the package was opened
+	if s.LegacyCFB {
+		decrErr = decryptDiscoveryPkg(receivedData, s)
+	} else {
+		decrErr = s.OpenDiscoveryPkg(receivedData)
+		if decrErr == nil {
+			decrErr = this.handleReplayedPkg(receivedData)
+		}
+	}
 
 	if decrErr != nil {
 		return decrErr
 	}
 
-	s := new(security.Security)
-
-	expectedToken, err := s.GenerateDiscoReqToken()
-	if err != nil {
-		return err
-	}
+	validToken := s.ValidateDiscoReqToken(receivedData.PkgValidation)
 
 	appIpErr := this.handleMissingAppIp()
 	if appIpErr != nil {
@@ -187,25 +584,38 @@ func (this DefaultDiscoveryHandler) handleDiscoveryRequest(receivedData *discomo
 
 	//checking if we got a discovery request with correct validation string, making sure we are not processing the discovery
 	//package from your own discovery agent, checking if the package is of type discovery request
-	if receivedData.Type == discomodel.DISCOVERY_REQUEST && receivedData.PkgValidation == expectedToken {
+	if receivedData.Type == discomodel.DISCOVERY_REQUEST && validToken {
 		fmt.Println("Received Discovery Request")
-		if receivedData.RequesterIp != this.AppIp {
+		if !this.isOwnRequest(receivedData, source) {
 			fmt.Println("DiscoveryPkg message was validated")
-			return this.handleDiscoveryResponse(receivedData)
+			return this.handleDiscoveryResponse(receivedData, source)
 		} else {
 			fmt.Println("DiscoveryPkg message was dropped as a loopback discovery msg")
 		}
-	} else if receivedData.Type == discomodel.DISCOVERY_PACKAGE && receivedData.PkgValidation == expectedToken {
+	} else if this.isServicePkg(receivedData) && validToken {
 		fmt.Println("Received Discovery Package")
-		port, portError := strconv.Atoi(receivedData.AppServerPort)
 
-		if portError != nil {
+		if receivedData.Type != discomodel.DISCOVERY_PACKAGE && this.isOwnAnnouncement(receivedData) {
+			fmt.Println("DiscoveryPkg message was dropped as a loopback announcement")
+			return nil
+		}
+
+		if signErr := s.VerifyDiscoveryPkg(receivedData); signErr != nil {
+			fmt.Println("Dropped Discovery Package")
+			return signErr
+		}
+
+		targets, targetsError := this.discoveredTargets(receivedData, source.zone())
+
+		if targetsError != nil {
 			fmt.Println("Dropped Discovery Package")
-			return errors.New("Error parsing port into int: " + portError.Error())
+			return targetsError
 		}
 
 		if (this.DiscoveredTargets != nil) {
-			this.DiscoveredTargets <- discomodel.DiscoveredTarget{Ip: receivedData.AppServerIp, Port: port, Alias: receivedData.Alias}
+			for _, target := range targets {
+				this.DiscoveredTargets <- target
+			}
 		}
 	} else {
 		fmt.Println("DiscoveryPkg message was not validated or not recognized")
@@ -214,21 +624,134 @@ func (this DefaultDiscoveryHandler) handleDiscoveryRequest(receivedData *discomo
 	return nil
 }
 
-// send discovery response using discovery pkg model
-// data sent back is server ip, server port, hostname as alias for the discovered system
-func (this DefaultDiscoveryHandler) handleDiscoveryResponse(receivedData *discomodel.DiscoveryPkg) error {
-	e := this.handleDiscoveryHandlerStruct()
+// checks if package describes services: a response, an announcement or a goodbye
+// announcements and goodbyes are not supported in legacy cfb mode
+func (this DefaultDiscoveryHandler) isServicePkg(receivedData *discomodel.DiscoveryPkg) bool {
+	switch receivedData.Type {
+	case discomodel.DISCOVERY_PACKAGE:
+		return true
+	case discomodel.DISCOVERY_ANNOUNCE, discomodel.DISCOVERY_GOODBYE:
+		return !this.getSecurity().LegacyCFB
+	}
+	return false
+}
+
+// converts every service record of received package into a discovered target
+// package without records describes a single service in its App* attrs
+// zone is set on link local addresses of the targets, see requestSource.zone
+func (this DefaultDiscoveryHandler) discoveredTargets(receivedData *discomodel.DiscoveryPkg, zone string) ([]discomodel.DiscoveredTarget, error) {
+	records := receivedData.Records
+	if len(records) == 0 {
+		records = []discomodel.ServiceRecord{{ServiceType: receivedData.ServiceType,
+			InstanceName: receivedData.InstanceName,
+			Ip:           receivedData.AppServerIp,
+			Port:         receivedData.AppServerPort,
+			Attributes:   receivedData.Attributes}}
+	}
+
+	payload, e := this.unmarshalPayload(receivedData.Payload)
 
 	if e != nil {
-		return e
+		return nil, e
 	}
 
-	discoveryResponse, e1 := this.BuildDefaultEncryptedDiscoveryResponse(this.AppIp, this.AppPort)
+	status := discomodel.TARGET_STATUS_DISCOVERED
+	ttl := time.Duration(receivedData.Ttl) * time.Second
+	if receivedData.Type == discomodel.DISCOVERY_GOODBYE {
+		status = discomodel.TARGET_STATUS_LEFT
+		ttl = 0
+	} else if ttl <= 0 {
+		ttl = discomodel.DEFAULT_TTL
+	}
+	lastSeen := time.Now()
+
+	result := make([]discomodel.DiscoveredTarget, 0, len(records))
+	for _, record := range records {
+		port, e := strconv.Atoi(record.Port)
+
+		if e != nil {
+			return nil, errors.New("Error parsing port into int: " + e.Error())
+		}
+
+		ips := make([]string, 0, len(record.Ips)+1)
+		for _, ip := range append([]string{record.Ip}, record.Ips...) {
+			ips = append(ips, utils.WithZone(ip, zone))
+		}
+
+		result = append(result, discomodel.DiscoveredTarget{Id: receivedData.InstanceId,
+			Ip:           ips[0],
+			Ips:          ips,
+			Port:         port,
+			Alias:        receivedData.Alias,
+			ServiceType:  record.ServiceType,
+			InstanceName: record.InstanceName,
+			Status:       status,
+			Attributes:   record.Attributes,
+			Payload:      payload,
+			Ttl:          ttl,
+			LastSeen:     lastSeen,
+			RequestId:    receivedData.RequestId})
+	}
+
+	return result, nil
+}
+
+// send discovery response using discovery pkg model
+// data sent back is a record (server ip, server port, service type, instance name) for every
+// service matching the request, hostname as alias for the discovered system
+// response is sent to source of the request, or to its RequesterIp and RequesterPort, see DefaultDiscoveryHandler
+// RequestId of the request is echoed in the response
+func (this DefaultDiscoveryHandler) handleDiscoveryResponse(receivedData *discomodel.DiscoveryPkg, source *requestSource) error {
+	var discoveryResponses []discomodel.DiscoveryPkg
+	var e1 error
+
+	if this.getSecurity().LegacyCFB {
+		if e := this.handleDiscoveryHandlerStruct(); e != nil {
+			return e
+		}
+
+		var discoveryResponse discomodel.DiscoveryPkg
+		discoveryResponse, e1 = this.BuildDefaultEncryptedDiscoveryResponse(this.AppIp, this.AppPort)
+		discoveryResponses = []discomodel.DiscoveryPkg{discoveryResponse}
+	} else {
+		records, e := this.serviceRecords(discomodel.ServiceFilter{ServiceType: receivedData.ServiceType,
+			InstanceName: receivedData.InstanceName})
+
+		if e != nil {
+			return e
+		}
+
+		if len(records) == 0 {
+			fmt.Println("DiscoveryPkg message was dropped as it is looking for another service")
+			return nil
+		}
+
+		records = this.withoutKnownAnswers(receivedData, records)
+		if len(records) == 0 {
+			fmt.Println("DiscoveryPkg message was dropped as the requester already knows all the matching services")
+			return nil
+		}
+
+		// package is built after waiting, so its timestamp is fresh
+		time.Sleep(responseJitter(receivedData))
+		discoveryResponses, e1 = this.buildEncryptedServicePkgs(discomodel.DISCOVERY_PACKAGE, receivedData.RequestId, records)
+	}
 
 	if e1 != nil {
 		return errors.New("Error building default encrypted discovery response. " + e1.Error())
 	}
 
+	if source != nil && receivedData.ReplyToSource && !this.getSecurity().LegacyCFB {
+		for _, discoveryResponse := range discoveryResponses {
+			if e := this.SendDataTo(source.connection, source.address, discoveryResponse); e != nil {
+				return errors.New("Error sending discovery response data" + e.Error())
+			}
+		}
+
+		fmt.Println("Sent discovery data to requester : " + source.address.String())
+		return nil
+	}
+
 	ResponceConnection, e2 := this.GetResponseUdpConnection(receivedData.RequesterIp, receivedData.RequesterPort)
 
 	if e2 != nil {
@@ -237,24 +760,238 @@ func (this DefaultDiscoveryHandler) handleDiscoveryResponse(receivedData *discom
 
 	defer ResponceConnection.Close()
 
-	e3 := this.SendDataToConnection(ResponceConnection, discoveryResponse)
-
-	if e3 != nil {
-		return errors.New("Error sending discovery response data" + e3.Error())
+	for _, discoveryResponse := range discoveryResponses {
+		if e3 := this.SendDataToConnection(ResponceConnection, discoveryResponse); e3 != nil {
+			return errors.New("Error sending discovery response data" + e3.Error())
+		}
 	}
 
-	fmt.Println("Sent discovery data to requester : " + receivedData.RequesterIp + ":" + receivedData.RequesterPort)
+	fmt.Println("Sent discovery data to requester : " + utils.GetConnectionString(receivedData.RequesterIp, receivedData.RequesterPort))
 	return nil
 }
 
 /*
  this method builds a default response for discovery request and relies on DiscoveryPkg model
  setting validation string, server ip, server port, alias(hostname)
- using cfb encrytion for all the data
+ service type, instance name and attributes are taken from the handler
+ the whole package is sealed, unless security is in legacy cfb mode
 */
 func (this DefaultDiscoveryHandler) BuildDefaultEncryptedDiscoveryResponse(appIp string, appPort string) (discomodel.DiscoveryPkg, error) {
+	s := this.getSecurity()
+
+	if s.LegacyCFB {
+		return buildLegacyCFBDiscoveryResponse(s, appIp, appPort)
+	}
+
+	record, e := this.defaultServiceRecord(appIp, appPort)
+	if e != nil {
+		return discomodel.DiscoveryPkg{}, e
+	}
+
+	return this.buildEncryptedServicePkg(discomodel.DISCOVERY_PACKAGE, "", []discomodel.ServiceRecord{record})
+}
+
+// builds response holding records of all the services of handler matching filter
+// records that do not fit into one datagram are split across several packages
+// not supported in legacy cfb mode
+func (this DefaultDiscoveryHandler) BuildEncryptedDiscoveryResponse(filter discomodel.ServiceFilter) ([]discomodel.DiscoveryPkg, error) {
+	if this.getSecurity().LegacyCFB {
+		return nil, errors.New("Error: service records are not supported in legacy cfb mode")
+	}
+
+	records, e := this.serviceRecords(filter)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("Error: no service matches the filter")
+	}
+
+	return this.buildEncryptedServicePkgs(discomodel.DISCOVERY_PACKAGE, "", records)
+}
+
+// builds announcement of all the services of handler, see dminterface.DiscoveryAnnouncer
+func (this DefaultDiscoveryHandler) BuildEncryptedAnnouncement() ([]discomodel.DiscoveryPkg, error) {
+	return this.buildEncryptedAnnouncement(discomodel.DISCOVERY_ANNOUNCE)
+}
+
+// builds goodbye for all the services of handler, see dminterface.DiscoveryAnnouncer
+func (this DefaultDiscoveryHandler) BuildEncryptedGoodbye() ([]discomodel.DiscoveryPkg, error) {
+	return this.buildEncryptedAnnouncement(discomodel.DISCOVERY_GOODBYE)
+}
+
+// announcements are not supported in legacy cfb mode, as old agents would take them for garbage
+func (this DefaultDiscoveryHandler) buildEncryptedAnnouncement(pkgType int) ([]discomodel.DiscoveryPkg, error) {
+	if this.getSecurity().LegacyCFB {
+		return nil, errors.New("Error: announcements are not supported in legacy cfb mode")
+	}
+
+	records, e := this.serviceRecords(discomodel.ServiceFilter{})
+	if e != nil {
+		return nil, e
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("Error: handler has no service to announce")
+	}
+
+	return this.buildEncryptedServicePkgs(pkgType, "", records)
+}
+
+// same as buildEncryptedServicePkg, records that do not fit into one package are split
+// in halves until every part fits, a single record over the budget is an error
+func (this DefaultDiscoveryHandler) buildEncryptedServicePkgs(pkgType int, requestId string, records []discomodel.ServiceRecord) ([]discomodel.DiscoveryPkg, error) {
+	pkg, e := this.buildEncryptedServicePkg(pkgType, requestId, records)
+	if e == nil {
+		return []discomodel.DiscoveryPkg{pkg}, nil
+	}
+
+	if _, overBudget := e.(security.OverBudgetError); !overBudget || len(records) == 1 {
+		return nil, e
+	}
+
+	half := len(records) / 2
+	first, e := this.buildEncryptedServicePkgs(pkgType, requestId, records[:half])
+	if e != nil {
+		return nil, e
+	}
+
+	second, e := this.buildEncryptedServicePkgs(pkgType, requestId, records[half:])
+	if e != nil {
+		return nil, e
+	}
+
+	return append(first, second...), nil
+}
+
+// builds sealed package of given type holding given records
+// InstanceId is set to the id of handler, so the sender can recognize its own announcements
+// requestId is the id of the answered request, empty when package does not answer a request
+func (this DefaultDiscoveryHandler) buildEncryptedServicePkg(pkgType int, requestId string, records []discomodel.ServiceRecord) (discomodel.DiscoveryPkg, error) {
+	s := this.getSecurity()
+	token, err1 := s.GenerateDiscoReqToken()
+	hostname, err2 := os.Hostname()
+	payload, err3 := this.marshalPayload()
+
+	var err4 error
+	for _, record := range records {
+		if e := discomodel.ValidateAttributes(record.Attributes); e != nil {
+			err4 = e
+		}
+	}
+
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		var strBldr bytes.Buffer
+		strBldr.WriteString("Error while building Discovery Response:\n")
+
+		if err1 != nil {
+			strBldr.WriteString("\tToken Generate error: " + err1.Error() + "\n")
+		}
+
+		if err2 != nil {
+			strBldr.WriteString("\tHostname error: " + err2.Error() + "\n")
+		}
+
+		if err3 != nil {
+			strBldr.WriteString("\tPayload error: " + err3.Error() + "\n")
+		}
+
+		if err4 != nil {
+			strBldr.WriteString("\tAttributes error: " + err4.Error() + "\n")
+		}
+
+		return discomodel.DiscoveryPkg{}, errors.New(strBldr.String())
+	}
+
+	var ttl int64
+	if pkgType != discomodel.DISCOVERY_GOODBYE {
+		ttl = int64(this.getTtl() / time.Second)
+	}
+
+	return s.SealDiscoveryPkg(discomodel.DiscoveryPkg{Type: pkgType,
+		PkgValidation: token,
+		RequesterIp:   this.AppIp,
+		Alias:         hostname,
+		InstanceId:    this.getInstanceId(),
+		RequestId:     requestId,
+		Records:       records,
+		Payload:       payload,
+		Ttl:           ttl})
+}
+
+/*
+ checks if request was sent by the agent of handler itself. agents ask for replies on their
+ discovery server port, so a request naming AppIp and the port it was received on is their own.
+ Discover asks for replies on a socket of its own, so servers on the same host still answer it.
+ when the port a request was received on is not known, AppIp alone decides
+*/
+func (this DefaultDiscoveryHandler) isOwnRequest(receivedData *discomodel.DiscoveryPkg, source *requestSource) bool {
+	if !utils.SameIp(receivedData.RequesterIp, this.AppIp) {
+		return false
+	}
+
+	if source == nil {
+		return true
+	}
+
+	localAddress, ok := source.connection.LocalAddr().(*net.UDPAddr)
+	return !ok || strconv.Itoa(localAddress.Port) == receivedData.RequesterPort
+}
+
+/*
+ checks if announcement or goodbye was sent by handler itself.
+ other agents on the same host share the app ip, so own packages are told by instance id.
+ handlers announcing no service have no own announcements, as watchers without
+ AppPort share the default instance id with agents announcing Services only
+*/
+func (this DefaultDiscoveryHandler) isOwnAnnouncement(receivedData *discomodel.DiscoveryPkg) bool {
+	if receivedData.InstanceId == "" || (this.AppPort == "" && len(this.Services.Matching(discomodel.ServiceFilter{})) == 0) {
+		return false
+	}
+	return receivedData.InstanceId == this.getInstanceId()
+}
+
+// returns records that are not in the known answers of the request
+func (this DefaultDiscoveryHandler) withoutKnownAnswers(receivedData *discomodel.DiscoveryPkg,
+	records []discomodel.ServiceRecord) []discomodel.ServiceRecord {
+
+	if len(receivedData.KnownAnswers) == 0 {
+		return records
+	}
+
+	instanceId := this.getInstanceId()
+	result := make([]discomodel.ServiceRecord, 0, len(records))
+	for _, record := range records {
+		known := false
+		for _, knownAnswer := range receivedData.KnownAnswers {
+			if knownAnswer.Matches(instanceId, record) {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// returns random time to wait before answering request, up to MaxJitter of the request
+// but never more than discomodel.MAX_RESPONSE_JITTER
+func responseJitter(receivedData *discomodel.DiscoveryPkg) time.Duration {
+	maxJitter := time.Duration(receivedData.MaxJitter) * time.Millisecond
+	if maxJitter <= 0 {
+		return 0
+	} else if maxJitter > discomodel.MAX_RESPONSE_JITTER {
+		maxJitter = discomodel.MAX_RESPONSE_JITTER
+	}
+	return time.Duration(rand.Int63n(int64(maxJitter) + 1))
+}
 
-	s := new(security.Security)
+// builds discovery response with every field encrypted separately using cfb
+func buildLegacyCFBDiscoveryResponse(s *security.Security, appIp string, appPort string) (discomodel.DiscoveryPkg, error) {
 	AppServerIp, err1 := s.EncryptCFB([]byte(appIp))
 	port, err2 := s.EncryptCFB([]byte(appPort))
 	token, err3 := s.GenerateDiscoReqToken()
@@ -0,0 +1,514 @@
+package dmimpl_test
+
+import (
+	"encoding/gob"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanitizer/discovery/impl"
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/security"
+	"github.com/sanitizer/discovery/utils"
+)
+
+// sends data through an in-memory connection and lets handler process it
+func handleData(t *testing.T, handler dmimpl.DefaultDiscoveryHandler, data interface{}) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		if e := handler.SendDataToConnection(client, data); e != nil {
+			t.Error("Error sending data: " + e.Error())
+		}
+	}()
+
+	handler.HandleDataFromConnection(server)
+}
+
+// hands every package to handler, as if each was received as a datagram of its own
+func handlePackages(t *testing.T, handler dmimpl.DefaultDiscoveryHandler, packages []discomodel.DiscoveryPkg) {
+	for _, pkg := range packages {
+		handleData(t, handler, pkg)
+	}
+}
+
+// returns target from channel or false if there is none
+func receivedTarget(targets chan discomodel.DiscoveredTarget) (discomodel.DiscoveredTarget, bool) {
+	select {
+	case target := <-targets:
+		return target, true
+	default:
+		return discomodel.DiscoveredTarget{}, false
+	}
+}
+
+func TestDefaultDiscoveryHandler_Replay(t *testing.T) {
+	responder := dmimpl.DefaultDiscoveryHandler{}
+	response, e := responder.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080")
+
+	if e != nil {
+		t.Fatal("Error building response: " + e.Error())
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 2),
+		ReplayCache:       security.NewNonceCache(8)}
+
+	handleData(t, handler, response)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); !ok || target.Ip != "10.1.2.3" {
+		t.Errorf("Expected target 10.1.2.3 to be discovered, actual: %v", target)
+	}
+
+	handleData(t, handler, response)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); ok {
+		t.Errorf("Expected replayed response to be dropped, actual: %v", target)
+	}
+}
+
+func TestDefaultDiscoveryHandler_ClockSkew(t *testing.T) {
+	s := new(security.Security)
+	stale, _ := s.SealDiscoveryPkg(discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE,
+		AppServerIp:   "10.1.2.3",
+		AppServerPort: "8080",
+		Timestamp:     time.Now().Add(-time.Minute).UnixNano()})
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1),
+		MaxClockSkew:      time.Second * 10}
+
+	handleData(t, handler, stale)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); ok {
+		t.Errorf("Expected package outside of clock skew window to be dropped, actual: %v", target)
+	}
+}
+
+// pushes packages through handler from many goroutines at once, run with -race
+func stressDefaultDiscoveryHandler(t *testing.T, s *security.Security) {
+	const packages = 200
+
+	responder := dmimpl.DefaultDiscoveryHandler{Security: s}
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, packages),
+		Security:          s,
+		ReplayCache:       security.NewNonceCache(packages)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < packages; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, e := responder.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080")
+			if e != nil {
+				t.Error("Error building response: " + e.Error())
+				return
+			}
+
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				responder.SendDataToConnection(client, response)
+			}()
+
+			if e := handler.ReceiveDataFromConnection(server); e != nil {
+				t.Error("Error receiving data: " + e.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	timeout := time.After(time.Second * 5)
+	for i := 0; i < packages; i++ {
+		select {
+		case target := <-handler.DiscoveredTargets:
+			if target.Ip != "10.1.2.3" || target.Port != 8080 {
+				t.Fatalf("Expected target 10.1.2.3:8080, actual: %v", target)
+			}
+		case <-timeout:
+			t.Fatalf("Expected %d targets to be discovered, actual: %d", packages, i)
+		}
+	}
+}
+
+func TestDefaultDiscoveryHandler_Concurrent(t *testing.T) {
+	stressDefaultDiscoveryHandler(t, nil)
+}
+
+func TestDefaultDiscoveryHandler_ConcurrentLegacyCFB(t *testing.T) {
+	stressDefaultDiscoveryHandler(t, &security.Security{LegacyCFB: true})
+}
+
+// agents of the previous release encode straight into the connection, which sends
+// the gob type descriptor and the value as separate datagrams
+func TestDefaultDiscoveryHandler_LegacyGobStream(t *testing.T) {
+	s := &security.Security{LegacyCFB: true}
+	responder := dmimpl.DefaultDiscoveryHandler{Security: s}
+	response, e := responder.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080")
+	if e != nil {
+		t.Fatal("Error building response: " + e.Error())
+	}
+
+	connection, e := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal("Error creating listener: " + e.Error())
+	}
+	defer connection.Close()
+
+	sender, e := net.DialUDP("udp4", nil, connection.LocalAddr().(*net.UDPAddr))
+	if e != nil {
+		t.Fatal("Error connecting sender: " + e.Error())
+	}
+	defer sender.Close()
+
+	if e := gob.NewEncoder(sender).Encode(response); e != nil {
+		t.Fatal("Error sending response: " + e.Error())
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1),
+		Security:          s}
+
+	// one datagram per type descriptor, the value comes last
+	connection.SetDeadline(time.Now().Add(time.Second))
+	for datagrams := 1; ; datagrams++ {
+		if e := handler.HandleDataFromConnection(connection); e != nil {
+			t.Fatal("Expected target 10.1.2.3:8080 from a gob stream split into datagrams: " + e.Error())
+		}
+
+		target, ok := receivedTarget(handler.DiscoveredTargets)
+		if ok && datagrams == 1 {
+			t.Fatal("Expected gob stream to be split into several datagrams")
+		} else if ok {
+			if target.Ip != "10.1.2.3" || target.Port != 8080 {
+				t.Errorf("Expected target 10.1.2.3:8080, actual: %v", target)
+			}
+			return
+		}
+	}
+}
+
+func TestDefaultDiscoveryHandler_TrustedKeys(t *testing.T) {
+	trustedPublic, trustedPrivate, _ := security.GenerateSigningKey()
+	_, otherPrivate, _ := security.GenerateSigningKey()
+	trustedKeys := security.NewTrustedKeys(trustedPublic)
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1),
+		Security:          &security.Security{TrustedKeys: trustedKeys}}
+
+	impostor := dmimpl.DefaultDiscoveryHandler{Security: &security.Security{SigningKey: otherPrivate}}
+	response, _ := impostor.BuildDefaultEncryptedDiscoveryResponse("10.6.6.6", "5432")
+	handleData(t, handler, response)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); ok {
+		t.Errorf("Expected response signed by untrusted key to be dropped, actual: %v", target)
+	}
+
+	database := dmimpl.DefaultDiscoveryHandler{Security: &security.Security{SigningKey: trustedPrivate}}
+	response, _ = database.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "5432")
+	handleData(t, handler, response)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); !ok || target.Ip != "10.1.2.3" {
+		t.Errorf("Expected response signed by trusted key to be discovered, actual: %v", target)
+	}
+}
+
+type testPayload struct {
+	Version string
+	Weight  int
+}
+
+func TestDefaultDiscoveryHandler_Payload(t *testing.T) {
+	codec := dmimpl.GobPayloadCodec{Factory: func() interface{} { return new(testPayload) }}
+	responder := dmimpl.DefaultDiscoveryHandler{Payload: testPayload{Version: "v2", Weight: 10}, PayloadCodec: codec}
+	response, e := responder.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080")
+
+	if e != nil {
+		t.Fatal("Error building response with payload: " + e.Error())
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1),
+		PayloadCodec:      codec}
+	handleData(t, handler, response)
+
+	target, ok := receivedTarget(handler.DiscoveredTargets)
+	payload, isPayload := target.Payload.(*testPayload)
+
+	if !ok || !isPayload || payload.Version != "v2" || payload.Weight != 10 {
+		t.Errorf("Expected target with payload {v2 10}, actual: %v", target)
+	}
+
+	raw := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	response, _ = responder.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080")
+	handleData(t, raw, response)
+
+	if target, _ := receivedTarget(raw.DiscoveredTargets); target.Payload == nil {
+		t.Error("Expected raw payload on target when no codec is registered")
+	}
+}
+
+func TestDefaultDiscoveryHandler_Attributes(t *testing.T) {
+	responder := dmimpl.DefaultDiscoveryHandler{Attributes: map[string]string{"version": "2", "env": "staging"}}
+	response, e := responder.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080")
+
+	if e != nil {
+		t.Fatal("Error building response with attributes: " + e.Error())
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	handleData(t, handler, response)
+
+	target, ok := receivedTarget(handler.DiscoveredTargets)
+
+	if !ok || target.Attributes["version"] != "2" || target.Attributes["env"] != "staging" {
+		t.Errorf("Expected target with attributes version=2 env=staging, actual: %v", target)
+	}
+
+	invalid := dmimpl.DefaultDiscoveryHandler{Attributes: map[string]string{"a=b": "c"}}
+
+	if _, e := invalid.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080"); e == nil {
+		t.Error("Expected error building response with invalid attribute key")
+	}
+
+	oversized := dmimpl.DefaultDiscoveryHandler{Attributes: map[string]string{"blob": strings.Repeat("x", discomodel.DISCOVERY_PKG_BUDGET)}}
+
+	if _, e := oversized.BuildDefaultEncryptedDiscoveryResponse("10.1.2.3", "8080"); e == nil {
+		t.Error("Expected error building response over the datagram budget")
+	}
+}
+
+func TestDefaultDiscoveryHandler_Services(t *testing.T) {
+	services := dmimpl.NewServiceSet()
+	services.AddService(discomodel.ServiceRecord{ServiceType: "_http._tcp", InstanceName: "web", Port: "8080"})
+	services.AddService(discomodel.ServiceRecord{ServiceType: "_metrics._tcp", InstanceName: "web", Port: "9100"})
+	services.AddService(discomodel.ServiceRecord{ServiceType: "_db._tcp", InstanceName: "pg", Ip: "10.9.9.9", Port: "5432"})
+
+	responder := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", Services: services}
+	response, e := responder.BuildEncryptedDiscoveryResponse(discomodel.ServiceFilter{InstanceName: "web"})
+
+	if e != nil {
+		t.Fatal("Error building response with services: " + e.Error())
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 3)}
+	handlePackages(t, handler, response)
+
+	ports := make(map[int]string)
+	for target, ok := receivedTarget(handler.DiscoveredTargets); ok; target, ok = receivedTarget(handler.DiscoveredTargets) {
+		ports[target.Port] = target.Ip
+	}
+
+	if len(ports) != 2 || ports[8080] != "10.1.2.3" || ports[9100] != "10.1.2.3" {
+		t.Errorf("Expected targets 10.1.2.3:8080 and 10.1.2.3:9100 from one response, actual: %v", ports)
+	}
+
+	services.RemoveService("_http._tcp", "web")
+	services.RemoveService("_metrics._tcp", "web")
+
+	if _, e := responder.BuildEncryptedDiscoveryResponse(discomodel.ServiceFilter{InstanceName: "web"}); e == nil {
+		t.Error("Expected error building response when no service matches")
+	}
+}
+
+func TestDefaultDiscoveryHandler_AnnounceGoodbye(t *testing.T) {
+	announcer := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"}
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+
+	announcement, e := announcer.BuildEncryptedAnnouncement()
+	if e != nil {
+		t.Fatal("Error building announcement: " + e.Error())
+	}
+	handlePackages(t, handler, announcement)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); !ok || target.Port != 8080 || target.Status != discomodel.TARGET_STATUS_DISCOVERED {
+		t.Errorf("Expected announced target 10.1.2.3:8080 to be up, actual: %v", target)
+	}
+
+	goodbye, e := announcer.BuildEncryptedGoodbye()
+	if e != nil {
+		t.Fatal("Error building goodbye: " + e.Error())
+	}
+	handlePackages(t, handler, goodbye)
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); !ok || target.Port != 8080 || target.Status != discomodel.TARGET_STATUS_LEFT {
+		t.Errorf("Expected target 10.1.2.3:8080 saying goodbye to be down, actual: %v", target)
+	}
+
+	self := announcer
+	self.DiscoveredTargets = make(chan discomodel.DiscoveredTarget, 1)
+	announcement, _ = announcer.BuildEncryptedAnnouncement()
+	handlePackages(t, self, announcement)
+
+	if target, ok := receivedTarget(self.DiscoveredTargets); ok {
+		t.Errorf("Expected own announcement to be dropped, actual: %v", target)
+	}
+
+	sameHost := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "9090",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	announcement, _ = announcer.BuildEncryptedAnnouncement()
+	handlePackages(t, sameHost, announcement)
+
+	if target, ok := receivedTarget(sameHost.DiscoveredTargets); !ok || target.Port != 8080 {
+		t.Errorf("Expected announcement of another agent on the same host to be received, actual: %v", target)
+	}
+
+	legacy := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080", Security: &security.Security{LegacyCFB: true}}
+	if _, e := legacy.BuildEncryptedAnnouncement(); e == nil {
+		t.Error("Expected error building announcement in legacy cfb mode")
+	}
+}
+
+func TestDefaultDiscoveryHandler_LocalAppIps(t *testing.T) {
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	handlePackages(t, handler, announcementOf(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"}))
+
+	if target, ok := receivedTarget(handler.DiscoveredTargets); !ok || len(target.Ips) != 1 {
+		t.Errorf("Expected only app ip of a target whose app ip is not local, actual: %v", target)
+	}
+
+	appIp := localIpv4(t)
+	handlePackages(t, handler, announcementOf(t, dmimpl.DefaultDiscoveryHandler{AppIp: appIp, AppPort: "8080"}))
+
+	expected, _ := utils.GetOtherFamilyIps(appIp, dmimpl.MAX_LOCAL_APP_IPS)
+	target, ok := receivedTarget(handler.DiscoveredTargets)
+	if !ok || len(target.Ips) != len(expected)+1 || len(target.Ips) > dmimpl.MAX_LOCAL_APP_IPS+1 || target.Ips[0] != appIp {
+		t.Errorf("Expected app ip %s and the ipv6 addresses of its interface %v, actual: %v", appIp, expected, target)
+	}
+}
+
+// returns ipv4 address of an up, non loopback interface, skips the test when there is none
+func localIpv4(t *testing.T) string {
+	interfaces, _ := net.Interfaces()
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addresses, _ := ifi.Addrs()
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+
+	t.Skip("host has no ipv4 address")
+	return ""
+}
+
+// packet connection returning a single datagram from address, as if it came in on the zone of address
+type zonedPacketConn struct {
+	net.PacketConn
+	datagram []byte
+	address  *net.UDPAddr
+}
+
+func (this *zonedPacketConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	return copy(buffer, this.datagram), this.address, nil
+}
+
+func (this *zonedPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("fe80::9"), Port: 6666, Zone: "eth7"}
+}
+
+func TestDefaultDiscoveryHandler_LinkLocalZones(t *testing.T) {
+	announcer := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppIps: []string{"fe80::1%eth0", "fd00::5"}, AppPort: "8080"}
+	announcement := announcementOf(t, announcer)
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	connection := &zonedPacketConn{datagram: announcement[0].Sealed,
+		address: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6666, Zone: "eth7"}}
+
+	if e := handler.HandleDataFromPacketConnection(connection); e != nil {
+		t.Fatal("Error handling announcement: " + e.Error())
+	}
+
+	target, ok := receivedTarget(handler.DiscoveredTargets)
+	if !ok || len(target.Ips) != 3 || target.Ips[1] != "fe80::1%eth7" || target.Ips[2] != "fd00::5" {
+		t.Errorf("Expected link local address with the zone of the receiving interface, actual: %v", target)
+	}
+}
+
+// returns announcement of announcer, fails the test if it can not be built
+func announcementOf(t *testing.T, announcer dmimpl.DefaultDiscoveryHandler) []discomodel.DiscoveryPkg {
+	announcement, e := announcer.BuildEncryptedAnnouncement()
+	if e != nil {
+		t.Fatal("Error building announcement: " + e.Error())
+	}
+	return announcement
+}
+
+func TestDefaultDiscoveryHandler_SplitOverBudget(t *testing.T) {
+	services := dmimpl.NewServiceSet()
+	for i := 0; i < 12; i++ {
+		services.AddService(discomodel.ServiceRecord{ServiceType: "_http._tcp", InstanceName: "web-" + strconv.Itoa(i),
+			Port: strconv.Itoa(8000 + i), Attributes: map[string]string{"description": strings.Repeat("x", 200)}})
+	}
+
+	announcer := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", Services: services}
+	announcement, e := announcer.BuildEncryptedAnnouncement()
+	if e != nil {
+		t.Fatal("Error building announcement over the budget: " + e.Error())
+	}
+
+	if len(announcement) < 2 {
+		t.Errorf("Expected announcement split across several packages, actual: %d", len(announcement))
+	}
+
+	for _, pkg := range announcement {
+		if len(pkg.Sealed) > discomodel.DISCOVERY_PKG_BUDGET {
+			t.Errorf("Expected every package to fit into %d bytes, actual: %d", discomodel.DISCOVERY_PKG_BUDGET, len(pkg.Sealed))
+		}
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 12)}
+	handlePackages(t, handler, announcement)
+
+	ports := make(map[int]bool)
+	for target, ok := receivedTarget(handler.DiscoveredTargets); ok; target, ok = receivedTarget(handler.DiscoveredTargets) {
+		ports[target.Port] = true
+	}
+
+	if len(ports) != 12 {
+		t.Errorf("Expected 12 targets from the split announcement, actual: %v", ports)
+	}
+
+	huge := dmimpl.NewServiceSet()
+	huge.AddService(discomodel.ServiceRecord{ServiceType: "_http._tcp", InstanceName: "web", Port: "8080",
+		Attributes: map[string]string{"description": strings.Repeat("x", 2*discomodel.DISCOVERY_PKG_BUDGET)}})
+
+	if _, e := (dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", Services: huge}).BuildEncryptedAnnouncement(); e == nil {
+		t.Error("Expected error building announcement of a single record over the budget")
+	}
+}
+
+func TestDefaultDiscoveryHandler_InstanceId(t *testing.T) {
+	registry := dmimpl.NewRegistry()
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+
+	for _, ip := range []string{"10.1.2.3", "10.1.2.4"} {
+		responder := dmimpl.DefaultDiscoveryHandler{AppIp: ip, AppPort: "8080", InstanceId: "web-instance"}
+		announcement, _ := responder.BuildEncryptedAnnouncement()
+		handlePackages(t, handler, announcement)
+
+		target, ok := receivedTarget(handler.DiscoveredTargets)
+		if !ok || target.Id != "web-instance" || target.Status != discomodel.TARGET_STATUS_DISCOVERED {
+			t.Fatalf("Expected discovered target with id web-instance, actual: %v", target)
+		}
+		registry.Update(target)
+	}
+
+	if targets := registry.Targets(); len(targets) != 1 || targets[0].Ip != "10.1.2.4" {
+		t.Errorf("Expected single target with the new ip after ip change, actual: %v", targets)
+	}
+}
@@ -0,0 +1,212 @@
+package dmimpl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/utils"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_INTERVAL = time.Second * 10
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = utils.DIAL_TIMEOUT
+	DEFAULT_HEALTHY_THRESHOLD     = 1
+	DEFAULT_UNHEALTHY_THRESHOLD   = 3
+)
+
+// probes target, returns error if target is not healthy
+// probe has to give up when ctx is done
+type HealthProbe func(ctx context.Context, target discomodel.DiscoveredTarget) error
+
+// target is healthy if a tcp connection to its ip and port can be opened
+func TcpProbe() HealthProbe {
+	return func(ctx context.Context, target discomodel.DiscoveredTarget) error {
+		if !utils.ConnectionIsLiveContext(ctx, "tcp", target.Ip, strconv.Itoa(target.Port)) {
+			return errors.New("Error: tcp connection to target can not be opened")
+		}
+		return nil
+	}
+}
+
+// target is healthy if http GET of path on its ip and port answers with 2xx or 3xx status
+func HttpProbe(path string) HealthProbe {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return func(ctx context.Context, target discomodel.DiscoveredTarget) error {
+		url := "http://" + utils.GetConnectionString(target.Ip, strconv.Itoa(target.Port)) + path
+		request, e := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if e != nil {
+			return errors.New("Error building health check request: " + e.Error())
+		}
+
+		response, e := http.DefaultClient.Do(request)
+		if e != nil {
+			return errors.New("Error sending health check request: " + e.Error())
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode < 200 || response.StatusCode >= 400 {
+			return errors.New("Error: health check answered with status " + response.Status)
+		}
+		return nil
+	}
+}
+
+/*
+	periodically probes every target of Registry and drives its status:
+	target becomes discomodel.TARGET_STATUS_HEALTHY after HealthyThreshold probes
+	in a row succeeded and discomodel.TARGET_STATUS_UNHEALTHY after UnhealthyThreshold
+	probes in a row failed. status changes are sent to registry watchers.
+	all attrs but Registry are optional:
+	Probe - default TcpProbe
+	Interval - time between probe rounds, default DEFAULT_HEALTH_CHECK_INTERVAL
+	Timeout - time a single probe may take, default DEFAULT_HEALTH_CHECK_TIMEOUT
+*/
+type HealthChecker struct {
+	Registry           *Registry
+	Probe              HealthProbe
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	mutex              sync.Mutex
+	results            map[string]int
+}
+
+func (this *HealthChecker) getProbe() HealthProbe {
+	if this.Probe == nil {
+		return TcpProbe()
+	}
+	return this.Probe
+}
+
+func (this *HealthChecker) getInterval() time.Duration {
+	if this.Interval <= 0 {
+		return DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	return this.Interval
+}
+
+func (this *HealthChecker) getTimeout() time.Duration {
+	if this.Timeout <= 0 {
+		return DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	return this.Timeout
+}
+
+func (this *HealthChecker) getHealthyThreshold() int {
+	if this.HealthyThreshold <= 0 {
+		return DEFAULT_HEALTHY_THRESHOLD
+	}
+	return this.HealthyThreshold
+}
+
+func (this *HealthChecker) getUnhealthyThreshold() int {
+	if this.UnhealthyThreshold <= 0 {
+		return DEFAULT_UNHEALTHY_THRESHOLD
+	}
+	return this.UnhealthyThreshold
+}
+
+// probes all the targets now and then every Interval, until ctx is done
+func (this *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(this.getInterval())
+	defer ticker.Stop()
+
+	for {
+		this.CheckAll(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probes all the targets of registry once, concurrently, and returns when all the probes are done
+func (this *HealthChecker) CheckAll(ctx context.Context) {
+	targets := this.Registry.Targets()
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target discomodel.DiscoveredTarget) {
+			defer wg.Done()
+			this.check(ctx, target)
+		}(target)
+	}
+	wg.Wait()
+
+	this.forgetRemovedTargets(targets)
+}
+
+// probes target and sets its status once a threshold is reached
+func (this *HealthChecker) check(ctx context.Context, target discomodel.DiscoveredTarget) {
+	probeCtx, cancel := context.WithTimeout(ctx, this.getTimeout())
+	e := this.getProbe()(probeCtx, target)
+	cancel()
+
+	if ctx.Err() != nil {
+		// checker is stopping, failure does not say anything about the target
+		return
+	}
+
+	identity := target.Identity()
+	inRow := this.recordResult(identity, e == nil)
+
+	if inRow >= this.getHealthyThreshold() {
+		this.Registry.SetStatus(identity, discomodel.TARGET_STATUS_HEALTHY)
+	} else if -inRow >= this.getUnhealthyThreshold() {
+		this.Registry.SetStatus(identity, discomodel.TARGET_STATUS_UNHEALTHY)
+	}
+}
+
+// counts probe results in a row: positive for successes, negative for failures
+func (this *HealthChecker) recordResult(identity string, healthy bool) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.results == nil {
+		this.results = make(map[string]int)
+	}
+
+	inRow := this.results[identity]
+	if healthy && inRow > 0 {
+		inRow++
+	} else if healthy {
+		inRow = 1
+	} else if inRow < 0 {
+		inRow--
+	} else {
+		inRow = -1
+	}
+
+	this.results[identity] = inRow
+	return inRow
+}
+
+// drops results of targets that are not in registry anymore
+func (this *HealthChecker) forgetRemovedTargets(targets []discomodel.DiscoveredTarget) {
+	current := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		current[target.Identity()] = true
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for identity := range this.results {
+		if !current[identity] {
+			delete(this.results, identity)
+		}
+	}
+}
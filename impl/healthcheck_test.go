@@ -0,0 +1,120 @@
+package dmimpl_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sanitizer/discovery/impl"
+	"github.com/sanitizer/discovery/model"
+)
+
+// returns target pointing to the address of a listener
+func targetOf(t *testing.T, alias string, address string) discomodel.DiscoveredTarget {
+	host, port, _ := net.SplitHostPort(address)
+	portNumber, e := strconv.Atoi(port)
+	if e != nil {
+		t.Fatal("Error parsing port: " + e.Error())
+	}
+	return discomodel.DiscoveredTarget{Ip: host, Port: portNumber, Alias: alias, Ttl: time.Minute}
+}
+
+func TestHealthChecker_Tcp(t *testing.T) {
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal("Error listening: " + e.Error())
+	}
+	defer listener.Close()
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	registry := dmimpl.NewRegistry()
+	live := targetOf(t, "live", listener.Addr().String())
+	dead := targetOf(t, "dead", closedAddress)
+	registry.Update(live)
+	registry.Update(dead)
+
+	checker := dmimpl.HealthChecker{Registry: registry, Timeout: time.Second, UnhealthyThreshold: 2}
+	checker.CheckAll(context.Background())
+
+	if target, _ := registry.Get(dead.Identity()); target.Status != discomodel.TARGET_STATUS_DISCOVERED {
+		t.Errorf("Expected dead target to stay discovered below the threshold, actual: %v", target.Status)
+	}
+
+	checker.CheckAll(context.Background())
+
+	if target, _ := registry.Get(live.Identity()); target.Status != discomodel.TARGET_STATUS_HEALTHY {
+		t.Errorf("Expected live target to be healthy, actual: %v", target.Status)
+	}
+
+	if target, _ := registry.Get(dead.Identity()); target.Status != discomodel.TARGET_STATUS_UNHEALTHY {
+		t.Errorf("Expected dead target to be unhealthy, actual: %v", target.Status)
+	}
+
+	// refresh by a new announcement keeps health status
+	registry.Update(live)
+
+	if target, _ := registry.Get(live.Identity()); target.Status != discomodel.TARGET_STATUS_HEALTHY {
+		t.Errorf("Expected refreshed target to stay healthy, actual: %v", target.Status)
+	}
+}
+
+func TestHealthChecker_Http(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	registry := dmimpl.NewRegistry()
+	target := targetOf(t, "web", server.Listener.Addr().String())
+	registry.Update(target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := registry.Watch(ctx, discomodel.ServiceFilter{})
+	nextEvent(t, events)
+
+	checker := dmimpl.HealthChecker{Registry: registry, Probe: dmimpl.HttpProbe("health")}
+	checker.CheckAll(context.Background())
+
+	event := nextEvent(t, events)
+	if event.Type != discomodel.TARGET_UPDATED || event.Target.Status != discomodel.TARGET_STATUS_HEALTHY {
+		t.Errorf("Expected status change event to healthy, actual: %v", event)
+	}
+
+	checker = dmimpl.HealthChecker{Registry: registry, Probe: dmimpl.HttpProbe("/missing"), UnhealthyThreshold: 1}
+	checker.CheckAll(context.Background())
+
+	if event := nextEvent(t, events); event.Target.Status != discomodel.TARGET_STATUS_UNHEALTHY {
+		t.Errorf("Expected status change event to unhealthy, actual: %v", event)
+	}
+}
+
+func TestHealthChecker_CustomProbe(t *testing.T) {
+	registry := dmimpl.NewRegistry()
+	target := discomodel.DiscoveredTarget{Ip: "10.1.2.3", Port: 8080, Alias: "web", Attributes: map[string]string{"ready": "no"}}
+	registry.Update(target)
+
+	probe := func(ctx context.Context, target discomodel.DiscoveredTarget) error {
+		if target.Attributes["ready"] != "yes" {
+			return errors.New("not ready")
+		}
+		return nil
+	}
+
+	checker := dmimpl.HealthChecker{Registry: registry, Probe: probe, UnhealthyThreshold: 1}
+	checker.CheckAll(context.Background())
+
+	if result, _ := registry.Get(target.Identity()); result.Status != discomodel.TARGET_STATUS_UNHEALTHY {
+		t.Errorf("Expected target rejected by custom probe to be unhealthy, actual: %v", result.Status)
+	}
+}
@@ -0,0 +1,108 @@
+package dmimpl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// environment variable with the dir instance id files are kept in, see DefaultInstanceIdPath
+const INSTANCE_ID_DIR_ENV_VARIABLE = "DISCOVERY_INSTANCE_ID_DIR"
+
+// number of random bytes of a generated instance id
+const INSTANCE_ID_SIZE = 16
+
+// generates a new random instance id
+func NewInstanceId() (string, error) {
+	id := make([]byte, INSTANCE_ID_SIZE)
+	if _, e := rand.Read(id); e != nil {
+		return "", errors.New("Error generating instance id: " + e.Error())
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// path of the file the instance id of agent with agentKey is kept in, every agent has a file
+// of its own in INSTANCE_ID_DIR_ENV_VARIABLE if set, otherwise in discovery in the user config dir
+func DefaultInstanceIdPath(agentKey string) (string, error) {
+	dir := os.Getenv(INSTANCE_ID_DIR_ENV_VARIABLE)
+	if dir == "" {
+		configDir, e := os.UserConfigDir()
+		if e != nil {
+			return "", errors.New("Error finding user config dir: " + e.Error())
+		}
+		dir = filepath.Join(configDir, "discovery")
+	}
+
+	return filepath.Join(dir, "instance-id-"+agentKey), nil
+}
+
+// reads instance id from the file, a new one is generated and written to the file
+// if there is none yet, so the id survives restarts of the agent
+func LoadOrCreateInstanceId(path string) (string, error) {
+	content, e := os.ReadFile(path)
+	if e == nil && len(bytes.TrimSpace(content)) > 0 {
+		return string(bytes.TrimSpace(content)), nil
+	} else if e != nil && !os.IsNotExist(e) {
+		return "", errors.New("Error reading instance id file: " + e.Error())
+	}
+
+	id, e := NewInstanceId()
+	if e != nil {
+		return "", e
+	}
+
+	if e := os.MkdirAll(filepath.Dir(path), 0700); e != nil {
+		return "", errors.New("Error creating instance id dir: " + e.Error())
+	}
+
+	if e := os.WriteFile(path, []byte(id+"\n"), 0600); e != nil {
+		return "", errors.New("Error writing instance id file: " + e.Error())
+	}
+
+	return id, nil
+}
+
+// default instance ids by agent key, loaded once per process
+var defaultInstanceIds = struct {
+	mutex sync.Mutex
+	ids   map[string]string
+}{ids: make(map[string]string)}
+
+// instance id used by handlers without their own, loaded from DefaultInstanceIdPath once per agent key.
+// when the file can not be used, the id is generated for the lifetime of the process only
+func getDefaultInstanceId(agentKey string) string {
+	defaultInstanceIds.mutex.Lock()
+	defer defaultInstanceIds.mutex.Unlock()
+
+	if id, ok := defaultInstanceIds.ids[agentKey]; ok {
+		return id
+	}
+
+	path, e := DefaultInstanceIdPath(agentKey)
+	var id string
+	if e == nil {
+		id, e = LoadOrCreateInstanceId(path)
+	}
+
+	if e != nil {
+		fmt.Println("Instance id is not persisted: " + e.Error())
+		id, _ = NewInstanceId()
+	}
+
+	defaultInstanceIds.ids[agentKey] = id
+	return id
+}
+
+// key telling agents on one host apart by the service they expose, the app ip is left out,
+// so the key survives ip changes
+func instanceIdKey(appPort string, serviceType string, instanceName string) string {
+	sum := sha256.Sum256([]byte(strconv.Quote(appPort) + strconv.Quote(serviceType) + strconv.Quote(instanceName)))
+	return hex.EncodeToString(sum[:8])
+}
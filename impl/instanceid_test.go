@@ -0,0 +1,69 @@
+package dmimpl_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sanitizer/discovery/impl"
+	"github.com/sanitizer/discovery/model"
+)
+
+// handlers without InstanceId persist their ids, which must not end up in the home dir
+func TestMain(m *testing.M) {
+	dir, e := os.MkdirTemp("", "discovery-instance-id")
+	if e != nil {
+		fmt.Println("Error creating instance id dir: " + e.Error())
+		os.Exit(1)
+	}
+
+	os.Setenv(dmimpl.INSTANCE_ID_DIR_ENV_VARIABLE, dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestLoadOrCreateInstanceId(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "discovery", "instance-id")
+
+	created, e := dmimpl.LoadOrCreateInstanceId(path)
+	if e != nil || created == "" {
+		t.Fatalf("LoadOrCreateInstanceId() == %q, %v, wanted a new id", created, e)
+	}
+
+	loaded, e := dmimpl.LoadOrCreateInstanceId(path)
+	if e != nil || loaded != created {
+		t.Errorf("LoadOrCreateInstanceId() == %q, %v, wanted persisted id %q", loaded, e, created)
+	}
+}
+
+// returns id of the target announced by responder
+func announcedId(t *testing.T, responder dmimpl.DefaultDiscoveryHandler) string {
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	announcement, e := responder.BuildEncryptedAnnouncement()
+	if e != nil {
+		t.Fatal("Error building announcement: " + e.Error())
+	}
+
+	handlePackages(t, handler, announcement)
+	target, ok := receivedTarget(handler.DiscoveredTargets)
+	if !ok || target.Id == "" {
+		t.Fatalf("Expected announced target with an id, actual: %v", target)
+	}
+	return target.Id
+}
+
+func TestDefaultDiscoveryHandler_DefaultInstanceIdPerAgent(t *testing.T) {
+	first := announcedId(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"})
+	second := announcedId(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8081"})
+	moved := announcedId(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.4", AppPort: "8080"})
+
+	if first == second {
+		t.Errorf("Expected agents with different app ports to have different ids, both have %q", first)
+	}
+
+	if first != moved {
+		t.Errorf("Expected id to survive ip change, actual: %q and %q", first, moved)
+	}
+}
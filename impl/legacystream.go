@@ -0,0 +1,79 @@
+package dmimpl
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+)
+
+// number of senders whose unfinished gob streams are kept at the same time
+const LEGACY_STREAM_CACHE_SIZE = 256
+
+/*
+	agents of the previous release encode packages straight into the connection,
+	gob writes the type descriptor and the value as separate datagrams then.
+	datagrams are kept by sender until they add up to a whole package.
+	safe for concurrent use
+*/
+type legacyStreams struct {
+	mutex   sync.Mutex
+	pending map[string][]byte
+}
+
+// shared by all the handlers, senders are told apart by local and remote address
+var defaultLegacyStreams = &legacyStreams{pending: make(map[string][]byte)}
+
+/*
+ decodes datagram received from source into pkg.
+ returns false without error when datagram is only the beginning of a stream.
+ when the kept datagrams and the new one do not decode together, the new one
+ is tried alone, as the rest of the previous stream could have been lost
+*/
+func (this *legacyStreams) decode(source string, datagram []byte, pkg *discomodel.DiscoveryPkg) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	pending, hasPending := this.pending[source]
+	delete(this.pending, source)
+
+	if hasPending {
+		stream := append(append([]byte{}, pending...), datagram...)
+		complete, e := this.decodeStream(source, stream, pkg)
+		if complete || e == nil {
+			return complete, e
+		}
+	}
+
+	return this.decodeStream(source, datagram, pkg)
+}
+
+// decodes stream into pkg, keeps it for source when it ends too early
+func (this *legacyStreams) decodeStream(source string, stream []byte, pkg *discomodel.DiscoveryPkg) (bool, error) {
+	decoded := discomodel.DiscoveryPkg{}
+	e := gob.NewDecoder(bytes.NewReader(stream)).Decode(&decoded)
+	if e == nil {
+		*pkg = decoded
+		return true, nil
+	} else if e != io.ErrUnexpectedEOF {
+		return false, e
+	}
+
+	if len(stream) > discomodel.MAX_DATAGRAM_SIZE {
+		return false, errors.New("Error: gob stream is larger than a datagram")
+	}
+
+	if len(this.pending) >= LEGACY_STREAM_CACHE_SIZE {
+		// senders that never finished their stream are forgotten first, which one does not matter
+		for key := range this.pending {
+			delete(this.pending, key)
+			break
+		}
+	}
+
+	this.pending[source] = stream
+	return false, nil
+}
@@ -0,0 +1,36 @@
+package dmimpl
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+/*
+	payload codec using gob
+	Factory returns a new instance of the payload model, e.g.
+	func() interface{} { return new(MyPayload) }
+*/
+type GobPayloadCodec struct {
+	Factory func() interface{}
+}
+
+func (this GobPayloadCodec) NewPayload() interface{} {
+	if this.Factory == nil {
+		return nil
+	}
+	return this.Factory()
+}
+
+func (this GobPayloadCodec) Marshal(payload interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	e := gob.NewEncoder(&buffer).Encode(payload)
+	return buffer.Bytes(), e
+}
+
+func (this GobPayloadCodec) Unmarshal(data []byte, payload interface{}) error {
+	if payload == nil {
+		return errors.New("Error: payload codec has no model to decode payload into")
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(payload)
+}
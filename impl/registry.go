@@ -0,0 +1,310 @@
+package dmimpl
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+)
+
+// how often Run removes expired targets
+const REGISTRY_EXPIRE_INTERVAL = time.Second
+
+/*
+	discovered targets keyed by discomodel.DiscoveredTarget.Identity.
+	a target is refreshed every time it is announced or answers again and expires when its
+	ttl lapses without hearing from it, or right away when it says goodbye.
+	registry maintains the status of targets, see discomodel.TARGET_STATUS_DISCOVERED:
+	refreshing a target keeps its health status, expired targets get TARGET_STATUS_EXPIRED.
+	expired targets are never returned, Expire (called periodically by Run) removes them.
+	changes are sent to watchers as discomodel.TargetEvent, see Watch.
+	safe for concurrent use
+*/
+type Registry struct {
+	mutex    sync.RWMutex
+	targets  map[string]discomodel.DiscoveredTarget
+	watchers map[*registryWatcher]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{targets: make(map[string]discomodel.DiscoveredTarget),
+		watchers: make(map[*registryWatcher]bool)}
+}
+
+/*
+ stores target or refreshes the stored one with the same identity.
+ target without LastSeen is seen now, target without Ttl gets discomodel.DEFAULT_TTL,
+ target without Status is discovered.
+ target that said goodbye or is already expired is removed instead,
+ returns false in that case.
+ refreshing a target without any change sends no event
+*/
+func (this *Registry) Update(target discomodel.DiscoveredTarget) bool {
+	now := time.Now()
+	if target.LastSeen.IsZero() {
+		target.LastSeen = now
+	}
+
+	if target.Status == "" {
+		target.Status = discomodel.TARGET_STATUS_DISCOVERED
+	}
+
+	if target.Ttl <= 0 && target.Status != discomodel.TARGET_STATUS_LEFT {
+		target.Ttl = discomodel.DEFAULT_TTL
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	identity := target.Identity()
+	previous, exists := this.targets[identity]
+
+	if target.IsExpired(now) {
+		if exists {
+			delete(this.targets, identity)
+			this.notify(discomodel.TargetEvent{Type: discomodel.TARGET_REMOVED, Target: target})
+		}
+		return false
+	}
+
+	if exists && target.Status == discomodel.TARGET_STATUS_DISCOVERED && isHealthStatus(previous.Status) {
+		target.Status = previous.Status
+	}
+
+	this.targets[identity] = target
+
+	if !exists {
+		this.notify(discomodel.TargetEvent{Type: discomodel.TARGET_ADDED, Target: target})
+	} else if changes := discomodel.DiffTargets(previous, target); len(changes) > 0 {
+		this.notify(discomodel.TargetEvent{Type: discomodel.TARGET_UPDATED, Target: target, Previous: previous, Changes: changes})
+	}
+	return true
+}
+
+// sets status of a stored target, e.g. by a health checker. status changes are sent
+// to watchers as TARGET_UPDATED. returns false if there is no such valid target
+func (this *Registry) SetStatus(identity string, status string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	previous, ok := this.targets[identity]
+	if !ok || previous.IsExpired(time.Now()) {
+		return false
+	}
+
+	if previous.Status != status {
+		target := previous
+		target.Status = status
+		this.targets[identity] = target
+		this.notify(discomodel.TargetEvent{Type: discomodel.TARGET_UPDATED, Target: target, Previous: previous,
+			Changes: discomodel.DiffTargets(previous, target)})
+	}
+	return true
+}
+
+// checks if status was set by a health checker
+func isHealthStatus(status string) bool {
+	return status == discomodel.TARGET_STATUS_HEALTHY || status == discomodel.TARGET_STATUS_UNHEALTHY
+}
+
+// removes target, returns false if there was no such target
+func (this *Registry) Remove(identity string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	target, ok := this.targets[identity]
+	if ok {
+		delete(this.targets, identity)
+		this.notify(discomodel.TargetEvent{Type: discomodel.TARGET_REMOVED, Target: target})
+	}
+	return ok
+}
+
+// removes targets expired at given time and returns them
+func (this *Registry) Expire(now time.Time) []discomodel.DiscoveredTarget {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	expired := make([]discomodel.DiscoveredTarget, 0)
+	for identity, target := range this.targets {
+		if target.IsExpired(now) {
+			target.Status = discomodel.TARGET_STATUS_EXPIRED
+			expired = append(expired, target)
+			delete(this.targets, identity)
+		}
+	}
+
+	sortTargets(expired)
+	for _, target := range expired {
+		this.notify(discomodel.TargetEvent{Type: discomodel.TARGET_EXPIRED, Target: target})
+	}
+	return expired
+}
+
+// returns target by identity, false if there is none or it expired
+func (this *Registry) Get(identity string) (discomodel.DiscoveredTarget, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	target, ok := this.targets[identity]
+	if !ok || target.IsExpired(time.Now()) {
+		return discomodel.DiscoveredTarget{}, false
+	}
+	return target, true
+}
+
+// returns all the valid targets sorted by identity
+func (this *Registry) Targets() []discomodel.DiscoveredTarget {
+	return this.matching(func(target discomodel.DiscoveredTarget) bool { return true })
+}
+
+// returns valid targets of agent with given alias (hostname)
+func (this *Registry) ByAlias(alias string) []discomodel.DiscoveredTarget {
+	return this.matching(func(target discomodel.DiscoveredTarget) bool { return target.Alias == alias })
+}
+
+// returns valid targets of given service type, case insensitive
+func (this *Registry) ByServiceType(serviceType string) []discomodel.DiscoveredTarget {
+	filter := discomodel.ServiceFilter{ServiceType: serviceType}
+	return this.matching(func(target discomodel.DiscoveredTarget) bool {
+		return filter.Matches(target.ServiceType, target.InstanceName)
+	})
+}
+
+func (this *Registry) matching(matches func(target discomodel.DiscoveredTarget) bool) []discomodel.DiscoveredTarget {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	now := time.Now()
+	result := make([]discomodel.DiscoveredTarget, 0)
+	for _, target := range this.targets {
+		if !target.IsExpired(now) && matches(target) {
+			result = append(result, target)
+		}
+	}
+
+	sortTargets(result)
+	return result
+}
+
+func sortTargets(targets []discomodel.DiscoveredTarget) {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Identity() < targets[j].Identity() })
+}
+
+/*
+ updates registry with targets received from the channel, e.g. DefaultDiscoveryHandler.DiscoveredTargets,
+ and removes expired targets every REGISTRY_EXPIRE_INTERVAL.
+ returns when ctx is done or the channel is closed
+*/
+func (this *Registry) Run(ctx context.Context, targets <-chan discomodel.DiscoveredTarget) {
+	ticker := time.NewTicker(REGISTRY_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case target, ok := <-targets:
+			if !ok {
+				return
+			}
+			this.Update(target)
+		case now := <-ticker.C:
+			this.Expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+ returns channel of changes of targets matching filter, starting with TARGET_ADDED
+ for every valid target that is already in the registry.
+ events are queued per watcher, so a slow watcher neither blocks the registry nor misses an event.
+ channel is closed when ctx is done
+*/
+func (this *Registry) Watch(ctx context.Context, filter discomodel.ServiceFilter) <-chan discomodel.TargetEvent {
+	watcher := &registryWatcher{filter: filter, signal: make(chan struct{}, 1)}
+	events := make(chan discomodel.TargetEvent)
+
+	this.mutex.Lock()
+	now := time.Now()
+	current := make([]discomodel.DiscoveredTarget, 0, len(this.targets))
+	for _, target := range this.targets {
+		if !target.IsExpired(now) {
+			current = append(current, target)
+		}
+	}
+	sortTargets(current)
+	for _, target := range current {
+		watcher.push(discomodel.TargetEvent{Type: discomodel.TARGET_ADDED, Target: target})
+	}
+	this.watchers[watcher] = true
+	this.mutex.Unlock()
+
+	go func() {
+		defer close(events)
+		watcher.pump(ctx, events)
+
+		this.mutex.Lock()
+		delete(this.watchers, watcher)
+		this.mutex.Unlock()
+	}()
+
+	return events
+}
+
+// queues event for every watcher interested in it, caller holds the lock
+func (this *Registry) notify(event discomodel.TargetEvent) {
+	for watcher := range this.watchers {
+		watcher.push(event)
+	}
+}
+
+// events waiting to be delivered to a single watcher
+type registryWatcher struct {
+	filter discomodel.ServiceFilter
+	mutex  sync.Mutex
+	queue  []discomodel.TargetEvent
+	signal chan struct{}
+}
+
+// queues event if it matches filter of watcher, never blocks
+func (this *registryWatcher) push(event discomodel.TargetEvent) {
+	if !this.filter.Matches(event.Target.ServiceType, event.Target.InstanceName) {
+		return
+	}
+
+	this.mutex.Lock()
+	this.queue = append(this.queue, event)
+	this.mutex.Unlock()
+
+	select {
+	case this.signal <- struct{}{}:
+	default:
+	}
+}
+
+// delivers queued events in order until ctx is done
+func (this *registryWatcher) pump(ctx context.Context, events chan<- discomodel.TargetEvent) {
+	for {
+		this.mutex.Lock()
+		queue := this.queue
+		this.queue = nil
+		this.mutex.Unlock()
+
+		for _, event := range queue {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-this.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package dmimpl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sanitizer/discovery/impl"
+	"github.com/sanitizer/discovery/model"
+)
+
+func TestRegistry_UpdateExpire(t *testing.T) {
+	registry := dmimpl.NewRegistry()
+	now := time.Now()
+
+	web := discomodel.DiscoveredTarget{Ip: "10.1.2.3", Port: 8080, Alias: "web-1", ServiceType: "_http._tcp",
+		Status: discomodel.TARGET_STATUS_DISCOVERED, Ttl: time.Second * 10, LastSeen: now}
+	db := discomodel.DiscoveredTarget{Ip: "10.1.2.4", Port: 5432, Alias: "db-1", ServiceType: "_db._tcp",
+		Status: discomodel.TARGET_STATUS_DISCOVERED, Ttl: time.Second * 10, LastSeen: now.Add(-time.Second * 9)}
+
+	registry.Update(web)
+	registry.Update(db)
+
+	if targets := registry.ByServiceType("_HTTP._tcp"); len(targets) != 1 || targets[0].Alias != "web-1" {
+		t.Errorf("ByServiceType() == %v, wanted web-1", targets)
+	}
+
+	if targets := registry.ByAlias("db-1"); len(targets) != 1 || targets[0].Port != 5432 {
+		t.Errorf("ByAlias() == %v, wanted db-1", targets)
+	}
+
+	if expired := registry.Expire(now.Add(time.Second * 2)); len(expired) != 1 || expired[0].Alias != "db-1" ||
+		expired[0].Status != discomodel.TARGET_STATUS_EXPIRED {
+		t.Errorf("Expire() == %v, wanted db-1 to expire", expired)
+	}
+
+	// re-announce extends the lease
+	web.LastSeen = now.Add(time.Second * 5)
+	registry.Update(web)
+
+	if expired := registry.Expire(now.Add(time.Second * 12)); len(expired) != 0 {
+		t.Errorf("Expire() == %v, wanted refreshed web-1 to stay", expired)
+	}
+
+	web.Status = discomodel.TARGET_STATUS_LEFT
+	if registry.Update(web) {
+		t.Error("Expected target saying goodbye not to be stored")
+	}
+
+	if targets := registry.Targets(); len(targets) != 0 {
+		t.Errorf("Targets() == %v, wanted none after goodbye", targets)
+	}
+}
+
+func TestRegistry_Run(t *testing.T) {
+	registry := dmimpl.NewRegistry()
+	targets := make(chan discomodel.DiscoveredTarget)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		registry.Run(ctx, targets)
+		close(done)
+	}()
+
+	targets <- discomodel.DiscoveredTarget{Ip: "10.1.2.3", Port: 8080, Alias: "web-1"}
+	cancel()
+	<-done
+
+	target, ok := registry.Get(discomodel.DiscoveredTarget{Ip: "10.1.2.3", Port: 8080, Alias: "web-1"}.Identity())
+	if !ok || target.Ttl != discomodel.DEFAULT_TTL {
+		t.Errorf("Expected target with default ttl in registry, actual: %v", target)
+	}
+}
+
+// returns next event or fails the test if there is none in time
+func nextEvent(t *testing.T, events <-chan discomodel.TargetEvent) discomodel.TargetEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Expected an event from watch")
+	}
+	return discomodel.TargetEvent{}
+}
+
+func TestRegistry_Watch(t *testing.T) {
+	registry := dmimpl.NewRegistry()
+	now := time.Now()
+
+	web := discomodel.DiscoveredTarget{Ip: "10.1.2.3", Port: 8080, Alias: "web-1", ServiceType: "_http._tcp",
+		Status: discomodel.TARGET_STATUS_DISCOVERED, Ttl: time.Second * 10, LastSeen: now}
+	registry.Update(web)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := registry.Watch(ctx, discomodel.ServiceFilter{ServiceType: "_http._tcp"})
+
+	if event := nextEvent(t, events); event.Type != discomodel.TARGET_ADDED || event.Target.Alias != "web-1" {
+		t.Errorf("Expected web-1 added from registry content, actual: %v", event)
+	}
+
+	// not matching the filter and refresh without change, neither is sent
+	registry.Update(discomodel.DiscoveredTarget{Ip: "10.1.2.4", Port: 5432, Alias: "db-1", ServiceType: "_db._tcp"})
+	web.LastSeen = now.Add(time.Second)
+	registry.Update(web)
+
+	web.Attributes = map[string]string{"version": "2"}
+	registry.Update(web)
+
+	event := nextEvent(t, events)
+	if event.Type != discomodel.TARGET_UPDATED || len(event.Changes) != 1 || event.Changes[0] != "Attributes" ||
+		event.Previous.Attributes != nil {
+		t.Errorf("Expected web-1 updated with changed attributes, actual: %v", event)
+	}
+
+	other := discomodel.DiscoveredTarget{Ip: "10.1.2.5", Port: 8080, Alias: "web-2", ServiceType: "_http._tcp",
+		Ttl: time.Second * 10, LastSeen: now}
+	registry.Update(other)
+
+	if event := nextEvent(t, events); event.Type != discomodel.TARGET_ADDED || event.Target.Alias != "web-2" {
+		t.Errorf("Expected web-2 added, actual: %v", event)
+	}
+
+	web.Status = discomodel.TARGET_STATUS_LEFT
+	registry.Update(web)
+
+	if event := nextEvent(t, events); event.Type != discomodel.TARGET_REMOVED || event.Target.Alias != "web-1" {
+		t.Errorf("Expected web-1 removed after goodbye, actual: %v", event)
+	}
+
+	registry.Expire(now.Add(time.Minute))
+
+	if event := nextEvent(t, events); event.Type != discomodel.TARGET_EXPIRED || event.Target.Alias != "web-2" {
+		t.Errorf("Expected web-2 expired, actual: %v", event)
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,79 @@
+package dmimpl
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+)
+
+/*
+	services announced by a DefaultDiscoveryHandler, keyed by service type and instance name.
+	services can be added and removed while the discovery server is running,
+	safe for concurrent use
+*/
+type ServiceSet struct {
+	mutex    sync.RWMutex
+	services map[string]discomodel.ServiceRecord
+}
+
+func NewServiceSet() *ServiceSet {
+	return &ServiceSet{services: make(map[string]discomodel.ServiceRecord)}
+}
+
+func serviceKey(serviceType string, instanceName string) string {
+	return serviceType + "/" + instanceName
+}
+
+// adds service or replaces the one with the same service type and instance name
+func (this *ServiceSet) AddService(record discomodel.ServiceRecord) error {
+	if record.Port == "" {
+		return errors.New("Error: service port was not set")
+	}
+
+	if e := discomodel.ValidateAttributes(record.Attributes); e != nil {
+		return e
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.services[serviceKey(record.ServiceType, record.InstanceName)] = record
+	return nil
+}
+
+// removes service, returns false if there was no such service
+func (this *ServiceSet) RemoveService(serviceType string, instanceName string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	key := serviceKey(serviceType, instanceName)
+	_, ok := this.services[key]
+	delete(this.services, key)
+	return ok
+}
+
+// returns services matching filter sorted by service type and instance name
+func (this *ServiceSet) Matching(filter discomodel.ServiceFilter) []discomodel.ServiceRecord {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	keys := make([]string, 0, len(this.services))
+	for key, record := range this.services {
+		if filter.Matches(record.ServiceType, record.InstanceName) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]discomodel.ServiceRecord, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, this.services[key])
+	}
+	return result
+}
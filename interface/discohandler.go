@@ -2,9 +2,64 @@ package dminterface
 
 import (
 	"net"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/security"
 )
 
+/*
+	implementation is responsible for writing data to the connection and for reading,
+	validating and handling whatever is received from it.
+	the model of the received data is defined by the implementation, a handler that
+	supports custom models lets the caller register a PayloadCodec for it
+*/
 type DiscoveryHandler interface {
 	SendDataToConnection(connection net.Conn, data interface{}) error
 	ReceiveDataFromConnection(connection net.Conn) error
 }
+
+/*
+	implemented by handlers that work on a single packet connection.
+	the source address of every received request is kept, so the reply is sent
+	back to where the request came from, instead of the address written in the request.
+	requester receives the replies on the same connection it sent the request from
+*/
+type PacketDiscoveryHandler interface {
+	DiscoveryHandler
+	SendDataTo(connection net.PacketConn, address net.Addr, data interface{}) error
+	ReceiveDataFromPacketConnection(connection net.PacketConn) error
+}
+
+/*
+	implemented by handlers that can announce their services without being asked.
+	discovery server broadcasts the announcement on start and periodically,
+	the goodbye when it is stopped. every package is sent as a datagram of its own,
+	so services that do not fit into one datagram are split across several packages
+*/
+type DiscoveryAnnouncer interface {
+	BuildEncryptedAnnouncement() ([]discomodel.DiscoveryPkg, error)
+	BuildEncryptedGoodbye() ([]discomodel.DiscoveryPkg, error)
+}
+
+/*
+	implemented by handlers that drop replayed packages. discovery server and Discover give
+	a handler without a replay cache a new one, so handlers receiving the same datagram on
+	sockets of their own do not take it for a replay of each other.
+	SetReplayCache may be implemented on the pointer, handlers passed by value are copied first
+*/
+type ReplayProtectedHandler interface {
+	HasReplayCache() bool
+	SetReplayCache(cache *security.NonceCache)
+}
+
+/*
+	defines the model of a custom payload carried in discovery packages along with the
+	default attrs, so richer announcements do not need a handler of their own.
+	NewPayload returns a new instance of the model (usually a pointer to a struct),
+	received payload is unmarshaled into it
+*/
+type PayloadCodec interface {
+	NewPayload() interface{}
+	Marshal(payload interface{}) ([]byte, error)
+	Unmarshal(data []byte, payload interface{}) error
+}
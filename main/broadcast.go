@@ -0,0 +1,14 @@
+package discovery
+
+/*
+	sends to the directed broadcast address of every subnet (e.g. 10.1.2.255 for 10.1.2.3/24)
+	of every up, broadcast capable interface, instead of the limited broadcast which leaves
+	through a single interface chosen by the routing table.
+	Include - names of the interfaces to use, default is all of them
+	Exclude - names of the interfaces to skip, e.g. docker0 or tun0
+*/
+type DirectedBroadcastOptions struct {
+	Enabled bool
+	Include []string
+	Exclude []string
+}
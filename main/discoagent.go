@@ -2,9 +2,14 @@ package discovery
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"strconv"
+	"sync"
 	"time"
 	// gitlab apis
 	"github.com/sanitizer/discovery/interface"
@@ -15,19 +20,41 @@ import (
 
 const (
 	DEFAULT_TIMEOUT = time.Second * 30
+	// size of random part of a request id in bytes
+	REQUEST_ID_SIZE = 8
 )
 
 /*
 	expect discovery ip and port to be set
 	other attrs are optional
 	default timeout 30 sec
+	default broadcast ip is discomodel.BROADCAST_IP
 	if stop server chan is not set
 	server will operate in infinite loop mode
+	Security has to hold the same pre-shared key as the DiscoveryHandler in use,
+	if not set a security with the library default key is used.
+	give agent and handler the same Security (or securities made by NewSecurityWithKeyring
+	from one keyring), so keys added or retired at runtime through Security.Keyring()
+	apply to both of them.
+	when AnnounceInterval is set and the handler implements dminterface.DiscoveryAnnouncer,
+	the server broadcasts an announcement to DiscoveryServerPort on start and every
+	AnnounceInterval, and a goodbye when it is stopped through StopDiscoveryServer.
+	when Multicast has a group, the server joins the group instead of listening for
+	broadcasts, and requests and announcements are sent to the group instead of BroadcastIp.
+	when DirectedBroadcast is enabled, requests and announcements are sent to the directed
+	broadcast address of every subnet of every local interface instead of BroadcastIp.
+	when the handler implements dminterface.PacketDiscoveryHandler, the server answers
+	requests from its own connection to the address they were received from
 */
 type DiscoveryAgent struct {
 	DiscoveryServerPort string
 	StopDiscoveryServer <-chan int // only receiving channel
 	ServerTimeout       time.Duration
+	BroadcastIp         string
+	Security            *security.Security
+	AnnounceInterval    time.Duration
+	Multicast           MulticastOptions
+	DirectedBroadcast   DirectedBroadcastOptions
 }
 
 func (this *DiscoveryAgent) String() string {
@@ -44,6 +71,14 @@ func (this *DiscoveryAgent) handleMissingDiscoveryServerPort() {
 	}
 }
 
+// returns security that was set on agent or the default one
+func (this *DiscoveryAgent) getSecurity() *security.Security {
+	if this.Security == nil {
+		return new(security.Security)
+	}
+	return this.Security
+}
+
 // infinite loop of accepting messages on udpconnection
 func handleInfiniteServerLoop(udpConnection net.Conn, dataManager dminterface.DiscoveryHandler) {
 	for {
@@ -53,10 +88,18 @@ func handleInfiniteServerLoop(udpConnection net.Conn, dataManager dminterface.Di
 
 // udpConnection - net.Conn with connection type UDP
 // dataManager - implementation of interface DiscoveryHandler
+// model of received data is defined by dataManager, see dminterface.PayloadCodec
+// handlers implementing dminterface.PacketDiscoveryHandler answer to the source address of requests
 func waitForDiscoMessage(udpConnection net.Conn,
 			 dataManager dminterface.DiscoveryHandler) {
 
-	//TODO i need some way to allow user to define what type of model they want to use
+	packetManager, isPacketManager := dataManager.(dminterface.PacketDiscoveryHandler)
+	packetConnection, isPacketConnection := udpConnection.(net.PacketConn)
+	if isPacketManager && isPacketConnection {
+		packetManager.ReceiveDataFromPacketConnection(packetConnection)
+		return
+	}
+
 	dataManager.ReceiveDataFromConnection(udpConnection)
 }
 
@@ -64,6 +107,19 @@ func waitForDiscoMessage(udpConnection net.Conn,
 func (this *DiscoveryAgent) GetServerUdpConnection() (net.Conn, error) {
 	this.handleMissingDiscoveryServerPort()
 
+	if this.Multicast.IsEnabled() {
+		port, e := strconv.Atoi(this.DiscoveryServerPort)
+		if e != nil {
+			return nil, errors.New("Error parsing discovery server port: " + e.Error())
+		}
+
+		connection, e := this.Multicast.listen(port)
+		if e != nil {
+			return nil, e
+		}
+		return connection, nil
+	}
+
 	// binding to port :PORT instead of IP:PORT, as has issues when trying to get broadcast message
 	serverIp, e2 := net.ResolveUDPAddr(discomodel.CONNECTION_TYPE_UDP, utils.GetConnectionString("", this.DiscoveryServerPort))
 	if e2 != nil {
@@ -74,10 +130,87 @@ func (this *DiscoveryAgent) GetServerUdpConnection() (net.Conn, error) {
 }
 
 //this function will build your a default encrypted package using DiscoveryPkg model
+//the whole package is sealed, unless security is in legacy cfb mode
+//every discovery server answers this request, see BuildEncryptedDiscoveryRequestForService
 func (this *DiscoveryAgent) BuildEncryptedDefaultDiscoveryRequest(discoServerIp string) (discomodel.DiscoveryPkg, error) {
+	return this.BuildEncryptedDiscoveryRequestForService(discoServerIp, discomodel.ServiceFilter{})
+}
+
+//same as BuildEncryptedDefaultDiscoveryRequest, but only servers whose service matches filter answer it
+//filters are not supported in legacy cfb mode
+func (this *DiscoveryAgent) BuildEncryptedDiscoveryRequestForService(discoServerIp string, filter discomodel.ServiceFilter) (discomodel.DiscoveryPkg, error) {
+	return this.BuildEncryptedDiscoveryQuery(discoServerIp, DiscoveryQuery{Filter: filter})
+}
+
+//same as BuildEncryptedDiscoveryRequestForService, requestId is echoed in every response to the request
+//and set on DiscoveredTarget.RequestId, so responses can be told apart from responses to other requests.
+//request ids are not supported in legacy cfb mode, requestId is left out
+func (this *DiscoveryAgent) BuildEncryptedDiscoveryRequestWithId(discoServerIp string,
+	filter discomodel.ServiceFilter,
+	requestId string) (discomodel.DiscoveryPkg, error) {
+
+	return this.BuildEncryptedDiscoveryQuery(discoServerIp, DiscoveryQuery{Filter: filter, RequestId: requestId})
+}
+
+//builds discovery request described by query, see DiscoveryQuery
+//in legacy cfb mode only the default request can be built, query attrs other than filter are left out
+func (this *DiscoveryAgent) BuildEncryptedDiscoveryQuery(discoServerIp string, query DiscoveryQuery) (discomodel.DiscoveryPkg, error) {
 	this.handleMissingDiscoveryServerPort()
 
-	s := new(security.Security)
+	s := this.getSecurity()
+	filter := query.Filter
+
+	if s.LegacyCFB && !filter.IsEmpty() {
+		return discomodel.DiscoveryPkg{}, errors.New("Error: service filter is not supported in legacy cfb mode")
+	} else if s.LegacyCFB {
+		return this.buildLegacyCFBDiscoveryRequest(s, discoServerIp)
+	}
+
+	requestId := query.RequestId
+	if requestId == "" {
+		var e error
+		if requestId, e = NewRequestId(); e != nil {
+			return discomodel.DiscoveryPkg{}, e
+		}
+	}
+
+	token, e := s.GenerateDiscoReqToken()
+	if e != nil {
+		return discomodel.DiscoveryPkg{}, errors.New("Error while building Discovery Request:\n\tToken Generate error: " + e.Error() + "\n")
+	}
+
+	request := discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_REQUEST,
+		PkgValidation:    token,
+		RequesterIp:      discoServerIp,
+		RequesterPort:    this.DiscoveryServerPort,
+		RequestId:        requestId,
+		MaxJitter:        query.maxJitterMillis(),
+		KnownAnswers:     query.KnownAnswers,
+		ReplyToSource:    query.ReplyToSource,
+		ServiceType:      filter.ServiceType,
+		InstanceName:     filter.InstanceName}
+
+	// known answers are only a hint, half of them is left out until the package fits into the budget
+	for {
+		sealed, e := s.SealDiscoveryPkg(request)
+		if _, overBudget := e.(security.OverBudgetError); !overBudget || len(request.KnownAnswers) == 0 {
+			return sealed, e
+		}
+		request.KnownAnswers = request.KnownAnswers[:len(request.KnownAnswers)/2]
+	}
+}
+
+// generates random hex encoded id of a discovery request
+func NewRequestId() (string, error) {
+	requestId := make([]byte, REQUEST_ID_SIZE)
+	if _, e := rand.Read(requestId); e != nil {
+		return "", errors.New("Error generating request id: " + e.Error())
+	}
+	return hex.EncodeToString(requestId), nil
+}
+
+// builds discovery request with every field encrypted separately using cfb
+func (this *DiscoveryAgent) buildLegacyCFBDiscoveryRequest(s *security.Security, discoServerIp string) (discomodel.DiscoveryPkg, error) {
 	token, err1 := s.GenerateDiscoReqToken()
 	encrPkgValidation, err2 := s.EncryptCFB([]byte(token))
 	encrLocalRequesterIp, err3 := s.EncryptCFB([]byte(discoServerIp))
@@ -123,6 +256,8 @@ func (this *DiscoveryAgent) BuildEncryptedDefaultDiscoveryRequest(discoServerIp
  dataManager - implementation of interface DiscoveryHandler
 */
 func (this *DiscoveryAgent) StartDiscoveryServer(dataManager dminterface.DiscoveryHandler) {
+	dataManager = withOwnReplayCache(dataManager)
+
 	udpConnection, e := this.GetServerUdpConnection()
 	if e != nil {
 		fmt.Printf("Error creating discovery server udp connection: %q", e.Error())
@@ -131,7 +266,13 @@ func (this *DiscoveryAgent) StartDiscoveryServer(dataManager dminterface.Discove
 
 	defer udpConnection.Close()
 
+	announcer, announces := dataManager.(dminterface.DiscoveryAnnouncer)
+	announces = announces && this.AnnounceInterval > 0
+
 	if this.StopDiscoveryServer == nil {
+		if announces {
+			this.startAnnouncing(dataManager, announcer)
+		}
 		handleInfiniteServerLoop(udpConnection, dataManager)
 	} else {
 		if this.ServerTimeout == 0 {
@@ -140,6 +281,11 @@ func (this *DiscoveryAgent) StartDiscoveryServer(dataManager dminterface.Discove
 
 		fmt.Printf("Discovery Server timeouts will happen every %q\n", this.ServerTimeout)
 
+		stopAnnouncing := func() {}
+		if announces {
+			stopAnnouncing = this.startAnnouncing(dataManager, announcer)
+		}
+
 	LOOP:
 		for {
 			select {
@@ -152,11 +298,92 @@ func (this *DiscoveryAgent) StartDiscoveryServer(dataManager dminterface.Discove
 				waitForDiscoMessage(udpConnection, dataManager)
 			}
 		}
+
+		stopAnnouncing()
+		if announces {
+			this.announce(dataManager, announcer.BuildEncryptedGoodbye)
+		}
 	}
 
 	fmt.Println("Discovery server was stopped")
 }
 
+/*
+ gives handler without a replay cache a cache of its own, see dminterface.ReplayProtectedHandler.
+ handler passed by value is copied into a new value, so the caller's handler is not changed
+ and handlers embedding a DefaultDiscoveryHandler keep their own type and methods
+*/
+func withOwnReplayCache(dataManager dminterface.DiscoveryHandler) dminterface.DiscoveryHandler {
+	value := reflect.ValueOf(dataManager)
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return dataManager
+	}
+
+	copied := value
+	if value.Kind() != reflect.Ptr {
+		copied = reflect.New(value.Type())
+		copied.Elem().Set(value)
+	}
+
+	handler, isProtected := copied.Interface().(dminterface.ReplayProtectedHandler)
+	if !isProtected || handler.HasReplayCache() {
+		return dataManager
+	}
+
+	handler.SetReplayCache(security.NewNonceCache(security.DEFAULT_NONCE_CACHE_SIZE))
+	if value.Kind() != reflect.Ptr {
+		return copied.Elem().Interface().(dminterface.DiscoveryHandler)
+	}
+	return dataManager
+}
+
+// broadcasts announcement now and then every AnnounceInterval, until returned func is called
+func (this *DiscoveryAgent) startAnnouncing(dataManager dminterface.DiscoveryHandler,
+	announcer dminterface.DiscoveryAnnouncer) func() {
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(this.AnnounceInterval)
+		defer ticker.Stop()
+
+		for {
+			this.announce(dataManager, announcer.BuildEncryptedAnnouncement)
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// builds announcement or goodbye and broadcasts it to discovery servers
+func (this *DiscoveryAgent) announce(dataManager dminterface.DiscoveryHandler,
+	build func() ([]discomodel.DiscoveryPkg, error)) {
+
+	packages, e := build()
+	if e != nil {
+		fmt.Println("Error building announcement: " + e.Error())
+		return
+	}
+
+	for _, data := range packages {
+		if e := this.BroadcastDiscoveryMessage(dataManager, data, this.DiscoveryServerPort); e != nil {
+			fmt.Println("Error broadcasting announcement: " + e.Error())
+		}
+	}
+}
+
 /*
  function creates udp connection using discovery ip
  sends default discovery request message to the discovery ip
@@ -166,8 +393,111 @@ func (this *DiscoveryAgent) StartDiscoveryServer(dataManager dminterface.Discove
  data - discomodel.DiscoveryPkg
 */
 func (this DiscoveryAgent) BroadcastDiscoveryMessage(dataManager dminterface.DiscoveryHandler, data interface{}, targetServerPort string) error {
+	if this.Multicast.IsEnabled() {
+		return this.multicastDiscoveryMessage(dataManager, data, targetServerPort)
+	} else if this.DirectedBroadcast.Enabled {
+		return this.directedBroadcastDiscoveryMessage(dataManager, data, targetServerPort)
+	}
+
+	return sendDiscoveryMessage(dataManager, data, this.getBroadcastIp(), targetServerPort)
+}
+
+/*
+ same as BroadcastDiscoveryMessage, but data is sent from connection instead of a new
+ connection per destination. sealed requests are marked with ReplyToSource, so discovery
+ servers answer to the source address of the request and the replies arrive on connection,
+ see dminterface.PacketDiscoveryHandler. servers running an older version and legacy cfb mode
+ requests are answered to RequesterIp and RequesterPort as before.
+ connection must not be connected and has to be of the same ip family as the destinations
+*/
+func (this DiscoveryAgent) SendDiscoveryMessageFrom(connection *net.UDPConn,
+	dataManager dminterface.PacketDiscoveryHandler,
+	data interface{},
+	targetServerPort string) error {
+
+	data = this.replyToSource(data)
+	send := func(address net.Addr) error {
+		return dataManager.SendDataTo(connection, address, data)
+	}
+
+	if this.Multicast.IsEnabled() {
+		port, e := strconv.Atoi(targetServerPort)
+		if e != nil {
+			return errors.New("Error parsing target server port: " + e.Error())
+		}
+		return this.Multicast.sendFrom(connection, port, send)
+	}
+
+	broadcastIps := []string{this.getBroadcastIp()}
+	if this.DirectedBroadcast.Enabled {
+		var e error
+		if broadcastIps, e = this.directedBroadcastIps(); e != nil {
+			return e
+		}
+	}
+
+	var strBldr bytes.Buffer
+	for _, broadcastIp := range broadcastIps {
+		address, e := net.ResolveUDPAddr(discomodel.CONNECTION_TYPE_UDP,
+			utils.GetConnectionString(broadcastIp, targetServerPort))
+
+		if e == nil {
+			e = send(address)
+		}
+
+		if e != nil {
+			strBldr.WriteString("\tError sending to " + broadcastIp + ": " + e.Error() + "\n")
+		}
+	}
+
+	if strBldr.Len() > 0 {
+		return errors.New("Error while broadcasting discovery message:\n" + strBldr.String())
+	}
+	return nil
+}
+
+/*
+ returns sealed request with ReplyToSource set, see discomodel.DiscoveryPkg.
+ request that already has it is returned as it is, so is anything else than a sealed request
+ and request that can not be opened with the security of agent
+*/
+func (this DiscoveryAgent) replyToSource(data interface{}) interface{} {
+	request, isPkg := data.(discomodel.DiscoveryPkg)
+	if !isPkg || len(request.Sealed) == 0 {
+		return data
+	}
+
+	s := this.getSecurity()
+	if e := s.OpenDiscoveryPkg(&request); e != nil || request.Type != discomodel.DISCOVERY_REQUEST || request.ReplyToSource {
+		return data
+	}
+
+	// sealed again as a new package, so it gets fresh timestamp, nonce and signature
+	request.ReplyToSource = true
+	request.Timestamp = 0
+	request.Nonce = ""
+	request.SignerKeyId = ""
+	request.Signature = nil
+
+	sealed, e := s.SealDiscoveryPkg(request)
+	if e != nil {
+		return data
+	}
+	return sealed
+}
+
+// returns broadcast ip that was set on agent or discomodel.BROADCAST_IP
+func (this DiscoveryAgent) getBroadcastIp() string {
+	if this.BroadcastIp == "" {
+		return discomodel.BROADCAST_IP
+	}
+	return this.BroadcastIp
+}
+
+// sends data to broadcast ip from a new udp connection
+func sendDiscoveryMessage(dataManager dminterface.DiscoveryHandler, data interface{}, broadcastIp string, targetServerPort string) error {
 	ServerAddr, e1 := net.ResolveUDPAddr(discomodel.CONNECTION_TYPE_UDP,
-		utils.GetConnectionString(discomodel.BROADCAST_IP, targetServerPort))
+		utils.GetConnectionString(broadcastIp, targetServerPort))
 
 	if e1 != nil {
 		return errors.New("Error resolving broadcast address" + e1.Error())
@@ -192,3 +522,62 @@ func (this DiscoveryAgent) BroadcastDiscoveryMessage(dataManager dminterface.Dis
 
 	return dataManager.SendDataToConnection(DiscoveryAgent, data)
 }
+
+// sends data to the multicast group on every interface of Multicast
+func (this DiscoveryAgent) multicastDiscoveryMessage(dataManager dminterface.DiscoveryHandler, data interface{}, targetServerPort string) error {
+	port, e := strconv.Atoi(targetServerPort)
+	if e != nil {
+		return errors.New("Error parsing target server port: " + e.Error())
+	}
+
+	connections, e := this.Multicast.dial(port)
+	if e != nil {
+		return e
+	}
+
+	var strBldr bytes.Buffer
+	for _, connection := range connections {
+		if e := dataManager.SendDataToConnection(connection, data); e != nil {
+			strBldr.WriteString("\tError sending to multicast group: " + e.Error() + "\n")
+		}
+		connection.Close()
+	}
+
+	if strBldr.Len() > 0 {
+		return errors.New("Error while multicasting discovery message:\n" + strBldr.String())
+	}
+	return nil
+}
+
+// sends data to the directed broadcast address of every subnet selected by DirectedBroadcast
+func (this DiscoveryAgent) directedBroadcastDiscoveryMessage(dataManager dminterface.DiscoveryHandler, data interface{}, targetServerPort string) error {
+	broadcastIps, e := this.directedBroadcastIps()
+	if e != nil {
+		return e
+	}
+
+	var strBldr bytes.Buffer
+	for _, broadcastIp := range broadcastIps {
+		if e := sendDiscoveryMessage(dataManager, data, broadcastIp, targetServerPort); e != nil {
+			strBldr.WriteString("\tError sending to " + broadcastIp + ": " + e.Error() + "\n")
+		}
+	}
+
+	if strBldr.Len() > 0 {
+		return errors.New("Error while broadcasting discovery message:\n" + strBldr.String())
+	}
+	return nil
+}
+
+// returns directed broadcast addresses of the subnets selected by DirectedBroadcast, at least one
+func (this DiscoveryAgent) directedBroadcastIps() ([]string, error) {
+	broadcastIps, e := utils.DirectedBroadcastIps(this.DirectedBroadcast.Include, this.DirectedBroadcast.Exclude)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(broadcastIps) == 0 {
+		return nil, errors.New("Error: no interface with a directed broadcast address was found")
+	}
+	return broadcastIps, nil
+}
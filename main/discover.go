@@ -0,0 +1,346 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+	// gitlab apis
+	"github.com/sanitizer/discovery/impl"
+	"github.com/sanitizer/discovery/interface"
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/security"
+	"github.com/sanitizer/discovery/utils"
+)
+
+const (
+	// used by Discover when the passed context has no deadline
+	DEFAULT_DISCOVER_WINDOW = time.Second * 3
+	// size of the channel between the listener and the collector in Discover
+	DISCOVER_TARGETS_BUFFER = 64
+	// used by Discover when MaxJitter is not set
+	DEFAULT_DISCOVER_MAX_JITTER = time.Millisecond * 100
+)
+
+/*
+	all attrs are optional
+	TargetServerPort - port discovery servers are listening on, default discomodel.DISCOVERY_PORT
+	BroadcastIp - where the discovery request is sent to, default discomodel.BROADCAST_IP
+	RequesterIp - ip sent in the request, responders running an older version send replies to it,
+	others answer to the source address of the request. default local ip from utils.GetLocalIpUsingLookup,
+	or from utils.GetLocalIpv6UsingLookup when Multicast uses an ipv6 group
+	ListenPort - local port the request is sent from and replies are collected on, default is an ephemeral port
+	Security - pre-shared key of the discovery domain, default is the library default key
+	PayloadCodec - model of custom payloads of targets, default is raw []byte payload
+	Filter - service type and instance name to look for, default is any service
+	Multicast - sends the request to a multicast group instead of BroadcastIp, see MulticastOptions
+	DirectedBroadcast - sends the request on every local subnet instead of BroadcastIp, see DirectedBroadcastOptions
+	MaxJitter - responders wait a random time up to MaxJitter before answering, default DEFAULT_DISCOVER_MAX_JITTER,
+	it has to be well below the discovery window, see DiscoveryQuery
+	KnownAnswers - targets that are already known, they do not answer and are not returned, see DiscoveryQuery
+	Retransmit - sends the request again during the discovery, see RetransmitOptions
+*/
+type DiscoverOptions struct {
+	TargetServerPort  string
+	BroadcastIp       string
+	RequesterIp       string
+	ListenPort        string
+	Security          *security.Security
+	PayloadCodec      dminterface.PayloadCodec
+	Filter            discomodel.ServiceFilter
+	Multicast         MulticastOptions
+	DirectedBroadcast DirectedBroadcastOptions
+	MaxJitter         time.Duration
+	KnownAnswers      []discomodel.KnownAnswer
+	Retransmit        RetransmitOptions
+}
+
+// sets defaults for all the attrs that were not set
+func (this *DiscoverOptions) handleMissingOptions() error {
+	if this.TargetServerPort == "" {
+		this.TargetServerPort = discomodel.DISCOVERY_PORT
+	}
+
+	if this.BroadcastIp == "" {
+		this.BroadcastIp = discomodel.BROADCAST_IP
+	}
+
+	if this.ListenPort == "" {
+		this.ListenPort = "0"
+	}
+
+	if this.MaxJitter <= 0 {
+		this.MaxJitter = DEFAULT_DISCOVER_MAX_JITTER
+	}
+
+	if this.RequesterIp == "" {
+		getLocalIp := utils.GetLocalIpUsingLookup
+		if this.Multicast.IsIpv6() {
+			getLocalIp = utils.GetLocalIpv6UsingLookup
+		}
+
+		ip, e := getLocalIp()
+		if e != nil {
+			return e
+		}
+		this.RequesterIp = ip
+	}
+
+	return nil
+}
+
+/*
+ udp4 or udp6 for the connection the request is sent from.
+ a dual-stack socket is not used, as broadcasts can not be sent from an ipv6 socket
+*/
+func (this *DiscoverOptions) network() string {
+	if this.Multicast.IsEnabled() {
+		return this.Multicast.network()
+	}
+
+	broadcastIp := net.ParseIP(this.BroadcastIp)
+	if broadcastIp != nil && broadcastIp.To4() == nil {
+		return discomodel.CONNECTION_TYPE_UDP + "6"
+	}
+	return discomodel.CONNECTION_TYPE_UDP + "4"
+}
+
+/*
+ one shot discovery.
+ opens a udp connection, broadcasts a default discovery request from it and collects
+ discovery packages arriving on it until the context is done.
+ the request is retransmitted according to opts.Retransmit, every time with a new request id.
+ if the context has no deadline, DEFAULT_DISCOVER_WINDOW is used.
+ only responses to the requests of this discovery are collected, see discomodel.DiscoveredTarget.RequestId,
+ so several discoveries may run at the same time and late responses to earlier ones are ignored.
+ servers running an older version do not echo request ids, so their responses are not collected.
+ in legacy cfb mode, which has no request ids, every response is collected.
+ targets are de-duplicated by discomodel.DiscoveredTarget.Identity.
+ reaching the deadline is not an error, cancelling the context is, in both cases
+ the targets collected so far are returned
+*/
+func Discover(ctx context.Context, opts DiscoverOptions) ([]discomodel.DiscoveredTarget, error) {
+	if e := opts.handleMissingOptions(); e != nil {
+		return nil, errors.New("Error setting discover options: " + e.Error())
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DEFAULT_DISCOVER_WINDOW)
+		defer cancel()
+	}
+
+	listenAddr, e := net.ResolveUDPAddr(opts.network(), utils.GetConnectionString("", opts.ListenPort))
+	if e != nil {
+		return nil, errors.New("Error resolving discover listener addr: " + e.Error())
+	}
+
+	udpConnection, e := net.ListenUDP(opts.network(), listenAddr)
+	if e != nil {
+		return nil, errors.New("Error creating discover udp listener: " + e.Error())
+	}
+
+	// port is known only after binding when ephemeral port was requested
+	agent := DiscoveryAgent{DiscoveryServerPort: strconv.Itoa(udpConnection.LocalAddr().(*net.UDPAddr).Port),
+		BroadcastIp:       opts.BroadcastIp,
+		Security:          opts.Security,
+		Multicast:         opts.Multicast,
+		DirectedBroadcast: opts.DirectedBroadcast}
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: opts.RequesterIp,
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, DISCOVER_TARGETS_BUFFER),
+		Security:          opts.Security,
+		ReplayCache:       security.NewNonceCache(security.DEFAULT_NONCE_CACHE_SIZE),
+		PayloadCodec:      opts.PayloadCodec}
+
+	// listener is started before the broadcast, so no early reply is lost
+	listenerCtx, stopListener := context.WithCancel(ctx)
+	defer stopListener()
+	listenerDone := make(chan struct{})
+	go func() {
+		defer close(listenerDone)
+		for {
+			e := handler.HandleDataFromPacketConnection(udpConnection)
+			if e != nil && listenerCtx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	round := newDiscoveryRound(opts.Filter, !agent.getSecurity().LegacyCFB)
+
+	// requests are sent from the goroutine collecting the responses, which owns round
+	send := func() error {
+		knownAnswers := opts.KnownAnswers
+		if opts.Retransmit.SuppressAnswered && round.requestCount() > 0 {
+			knownAnswers = append(append([]discomodel.KnownAnswer{}, opts.KnownAnswers...), round.knownAnswers()...)
+		}
+
+		requestId, e := NewRequestId()
+		var request discomodel.DiscoveryPkg
+		if e == nil {
+			request, e = agent.BuildEncryptedDiscoveryQuery(opts.RequesterIp, DiscoveryQuery{Filter: opts.Filter,
+				RequestId:    requestId,
+				MaxJitter:     opts.MaxJitter,
+				KnownAnswers:  knownAnswers,
+				ReplyToSource: true})
+		}
+
+		if e == nil {
+			round.addRequest(requestId)
+			e = agent.SendDiscoveryMessageFrom(udpConnection, handler, request, opts.TargetServerPort)
+		}
+		return e
+	}
+
+	if e := send(); e != nil {
+		stopListener()
+		udpConnection.Close()
+		<-listenerDone
+		return nil, errors.New("Error sending discovery request: " + e.Error())
+	}
+
+	return round.collect(ctx, opts.Retransmit.schedule(), send, handler.DiscoveredTargets, udpConnection, listenerDone)
+}
+
+/*
+ requests sent by one Discover call and targets collected from the responses.
+ requestIds holds ids of the requests sent so far, nil accepts responses to any request
+ (legacy cfb mode). targets answering several requests are collected once, the number
+ of requests they answered is counted in roundsSeen by their identity
+*/
+type discoveryRound struct {
+	filter     discomodel.ServiceFilter
+	requestIds map[string]bool
+	result     []discomodel.DiscoveredTarget
+	roundsSeen map[string]int
+	answered   map[string]bool
+}
+
+func newDiscoveryRound(filter discomodel.ServiceFilter, hasRequestIds bool) *discoveryRound {
+	round := &discoveryRound{filter: filter,
+		result:     make([]discomodel.DiscoveredTarget, 0),
+		roundsSeen: make(map[string]int),
+		answered:   make(map[string]bool)}
+
+	if hasRequestIds {
+		round.requestIds = make(map[string]bool)
+	}
+	return round
+}
+
+// remembers id of a sent request, so responses to it are collected
+func (this *discoveryRound) addRequest(requestId string) {
+	if this.requestIds != nil {
+		this.requestIds[requestId] = true
+	}
+}
+
+// number of requests sent so far, 0 in legacy cfb mode
+func (this *discoveryRound) requestCount() int {
+	return len(this.requestIds)
+}
+
+// returns known answers of the targets collected so far, targets without id are left out
+func (this *discoveryRound) knownAnswers() []discomodel.KnownAnswer {
+	result := make([]discomodel.KnownAnswer, 0, len(this.result))
+	for _, target := range this.result {
+		if target.Id != "" {
+			result = append(result, target.KnownAnswer())
+		}
+	}
+	return result
+}
+
+// collects target if it matches filter and answers one of the requests
+// filter is checked here as well, as servers running an older version answer every request
+func (this *discoveryRound) add(target discomodel.DiscoveredTarget) {
+	if this.requestIds != nil && !this.requestIds[target.RequestId] {
+		return
+	}
+
+	if !this.filter.Matches(target.ServiceType, target.InstanceName) {
+		return
+	}
+
+	key := target.Identity()
+	if this.roundsSeen[key] == 0 {
+		this.result = append(this.result, target)
+	}
+
+	// without request ids every response counts, as it can not be told which request it answers
+	answerKey := key + "/" + target.RequestId
+	if target.RequestId == "" || !this.answered[answerKey] {
+		this.answered[answerKey] = true
+		this.roundsSeen[key]++
+	}
+}
+
+// returns collected targets with their RoundsSeen set
+func (this *discoveryRound) targets() []discomodel.DiscoveredTarget {
+	for i := range this.result {
+		this.result[i].RoundsSeen = this.roundsSeen[this.result[i].Identity()]
+	}
+	return this.result
+}
+
+/*
+ collects targets until ctx is done, retransmitting the request using send
+ after every interval of schedule.
+ shutdown order matters: the connection is closed first, which unblocks the listener,
+ and the channel is drained until the listener exits, so the listener never blocks
+ on a channel nobody reads
+*/
+func (this *discoveryRound) collect(ctx context.Context,
+	schedule []time.Duration,
+	send func() error,
+	targets chan discomodel.DiscoveredTarget,
+	udpConnection net.Conn,
+	listenerDone chan struct{}) ([]discomodel.DiscoveredTarget, error) {
+
+	// nil channel never fires, once all the retransmissions are sent
+	var retransmit <-chan time.Time
+	scheduleNext := func() {
+		retransmit = nil
+		if len(schedule) > 0 {
+			retransmit = time.After(schedule[0])
+			schedule = schedule[1:]
+		}
+	}
+	scheduleNext()
+
+LOOP:
+	for {
+		select {
+		case target := <-targets:
+			this.add(target)
+		case <-retransmit:
+			if e := send(); e != nil {
+				fmt.Println("Error retransmitting discovery request: " + e.Error())
+			}
+			scheduleNext()
+		case <-ctx.Done():
+			break LOOP
+		}
+	}
+
+	udpConnection.Close()
+
+	for {
+		select {
+		case target := <-targets:
+			this.add(target)
+		case <-listenerDone:
+			// listener will not send anymore, taking what is left in the buffer
+			for len(targets) > 0 {
+				this.add(<-targets)
+			}
+
+			if ctx.Err() == context.DeadlineExceeded {
+				return this.targets(), nil
+			}
+			return this.targets(), ctx.Err()
+		}
+	}
+}
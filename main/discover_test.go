@@ -0,0 +1,635 @@
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sanitizer/discovery/impl"
+	"github.com/sanitizer/discovery/interface"
+	"github.com/sanitizer/discovery/main"
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/security"
+	"github.com/sanitizer/discovery/utils"
+)
+
+// handlers without InstanceId persist their ids, which must not end up in the home dir
+func TestMain(m *testing.M) {
+	dir, e := os.MkdirTemp("", "discovery-instance-id")
+	if e != nil {
+		fmt.Println("Error creating instance id dir: " + e.Error())
+		os.Exit(1)
+	}
+
+	os.Setenv(dmimpl.INSTANCE_ID_DIR_ENV_VARIABLE, dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// grabs a free udp port by binding to :0 and releasing it
+func freeUdpPort(t *testing.T) string {
+	connection, e := net.ListenUDP("udp", &net.UDPAddr{})
+	if e != nil {
+		t.Fatal("Error getting free udp port: " + e.Error())
+	}
+	defer connection.Close()
+	return strconv.Itoa(connection.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// starts discovery server answering for 10.1.2.3:8080 and runs Discover against it
+func discoverLocalServer(t *testing.T, s *security.Security) ([]discomodel.DiscoveredTarget, error) {
+	return discoverLocalService(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080", Security: s},
+		discovery.DiscoverOptions{Security: s})
+}
+
+// starts discovery server using handler and runs Discover with opts against it
+func discoverLocalService(t *testing.T,
+	handler dmimpl.DefaultDiscoveryHandler,
+	opts discovery.DiscoverOptions) ([]discomodel.DiscoveredTarget, error) {
+
+	return discoverLocalHandler(t, handler, handler.Security, opts)
+}
+
+// same as discoverLocalService for any handler, s is the security of the server
+func discoverLocalHandler(t *testing.T,
+	handler dminterface.DiscoveryHandler,
+	s *security.Security,
+	opts discovery.DiscoverOptions) ([]discomodel.DiscoveredTarget, error) {
+
+	port := freeUdpPort(t)
+	stop := make(chan int)
+	stopped := make(chan struct{})
+
+	agent := discovery.DiscoveryAgent{DiscoveryServerPort: port,
+		StopDiscoveryServer: stop,
+		ServerTimeout:       time.Millisecond * 100,
+		Security:            s}
+
+	go func() {
+		agent.StartDiscoveryServer(handler)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// giving the server a moment to bind
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	opts.TargetServerPort = port
+	opts.BroadcastIp = "127.0.0.1"
+	opts.RequesterIp = "127.0.0.1"
+	return discovery.Discover(ctx, opts)
+}
+
+func TestDiscover(t *testing.T) {
+	result, e := discoverLocalServer(t, nil)
+
+	if e != nil {
+		t.Fatal("Discover returned error: " + e.Error())
+	}
+
+	if len(result) != 1 || result[0].Ip != "10.1.2.3" || result[0].Port != 8080 {
+		t.Errorf("Discover() == %v, wanted a single target 10.1.2.3:8080", result)
+	}
+}
+
+func TestDiscover_LegacyCFB(t *testing.T) {
+	result, e := discoverLocalServer(t, &security.Security{LegacyCFB: true})
+
+	if e != nil {
+		t.Fatal("Discover returned error: " + e.Error())
+	}
+
+	if len(result) != 1 || result[0].Ip != "10.1.2.3" || result[0].Port != 8080 {
+		t.Errorf("Discover() in legacy cfb mode == %v, wanted a single target 10.1.2.3:8080", result)
+	}
+}
+
+func TestDiscover_Filter(t *testing.T) {
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080", ServiceType: "_billing._tcp", InstanceName: "billing-1"}
+
+	result, e := discoverLocalService(t, handler,
+		discovery.DiscoverOptions{Filter: discomodel.ServiceFilter{ServiceType: "_billing._tcp"}})
+
+	if e != nil || len(result) != 1 || result[0].ServiceType != "_billing._tcp" || result[0].InstanceName != "billing-1" {
+		t.Errorf("Discover() for _billing._tcp == %v, %v, wanted billing-1 target", result, e)
+	}
+
+	result, e = discoverLocalService(t, handler,
+		discovery.DiscoverOptions{Filter: discomodel.ServiceFilter{ServiceType: "_auth._tcp"}})
+
+	if e != nil || len(result) != 0 {
+		t.Errorf("Discover() for _auth._tcp == %v, %v, wanted no targets", result, e)
+	}
+}
+
+func TestDiscover_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, e := discovery.Discover(ctx, discovery.DiscoverOptions{TargetServerPort: freeUdpPort(t),
+		BroadcastIp: "127.0.0.1",
+		RequesterIp: "127.0.0.1"})
+
+	if e != context.Canceled {
+		t.Errorf("Discover() with cancelled context returned error %v, wanted context.Canceled", e)
+	}
+
+	if len(result) != 0 {
+		t.Errorf("Discover() with cancelled context == %v, wanted no targets", result)
+	}
+}
+
+// receives with watcher, announces services of announcer
+type announcingHandler struct {
+	dmimpl.DefaultDiscoveryHandler
+	announcer dmimpl.DefaultDiscoveryHandler
+}
+
+func (this announcingHandler) BuildEncryptedAnnouncement() ([]discomodel.DiscoveryPkg, error) {
+	return this.announcer.BuildEncryptedAnnouncement()
+}
+
+func (this announcingHandler) BuildEncryptedGoodbye() ([]discomodel.DiscoveryPkg, error) {
+	return this.announcer.BuildEncryptedGoodbye()
+}
+
+// starts discovery server using handler, returns its port and func stopping it
+func startLocalServer(t *testing.T, handler dminterface.DiscoveryHandler) (string, func()) {
+	stop := make(chan int)
+	stopped := make(chan struct{})
+	agent := discovery.DiscoveryAgent{DiscoveryServerPort: freeUdpPort(t),
+		StopDiscoveryServer: stop,
+		ServerTimeout:       time.Millisecond * 100}
+
+	go func() {
+		agent.StartDiscoveryServer(handler)
+		close(stopped)
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+	return agent.DiscoveryServerPort, func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// sends raw datagram to local port
+func sendDatagram(t *testing.T, port string, datagram []byte) {
+	connection, e := net.Dial("udp", "127.0.0.1:"+port)
+	if e != nil {
+		t.Fatal("Error dialing local server: " + e.Error())
+	}
+	defer connection.Close()
+
+	if _, e := connection.Write(datagram); e != nil {
+		t.Fatal("Error sending datagram: " + e.Error())
+	}
+}
+
+func TestDiscoveryAgent_OwnReplayCache(t *testing.T) {
+	first := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 2)}
+	second := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 2)}
+
+	firstPort, stopFirst := startLocalServer(t, first)
+	defer stopFirst()
+	secondPort, stopSecond := startLocalServer(t, second)
+	defer stopSecond()
+
+	announcement, e := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"}.BuildEncryptedAnnouncement()
+	if e != nil {
+		t.Fatal("Error building announcement: " + e.Error())
+	}
+
+	sendDatagram(t, firstPort, announcement[0].Sealed)
+	sendDatagram(t, secondPort, announcement[0].Sealed)
+
+	for i, targets := range []chan discomodel.DiscoveredTarget{first.DiscoveredTargets, second.DiscoveredTargets} {
+		select {
+		case target := <-targets:
+			if target.Ip != "10.1.2.3" {
+				t.Errorf("Expected server %d to receive target 10.1.2.3, actual: %v", i, target)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected server %d to receive the datagram received by the other server as well", i)
+		}
+	}
+
+	sendDatagram(t, firstPort, announcement[0].Sealed)
+
+	select {
+	case target := <-first.DiscoveredTargets:
+		t.Errorf("Expected replayed datagram to be dropped, actual: %v", target)
+	case <-time.After(time.Millisecond * 300):
+	}
+}
+
+func TestDiscoveryAgent_Announce(t *testing.T) {
+	handler := announcingHandler{
+		DefaultDiscoveryHandler: dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+			DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 8),
+			ReplayCache:       security.NewNonceCache(8)},
+		announcer: dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"}}
+
+	stop := make(chan int)
+	stopped := make(chan struct{})
+	agent := discovery.DiscoveryAgent{DiscoveryServerPort: freeUdpPort(t),
+		StopDiscoveryServer: stop,
+		ServerTimeout:       time.Millisecond * 100,
+		BroadcastIp:         "127.0.0.1",
+		AnnounceInterval:    time.Millisecond * 50}
+
+	go func() {
+		agent.StartDiscoveryServer(handler)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	select {
+	case target := <-handler.DiscoveredTargets:
+		if target.Ip != "10.1.2.3" || target.Port != 8080 || target.Status != discomodel.TARGET_STATUS_DISCOVERED {
+			t.Errorf("Expected announced target 10.1.2.3:8080 to be up, actual: %v", target)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected announcement to be received")
+	}
+}
+
+// starts discovery server joined to multicast group and runs Discover against it
+func discoverOverMulticast(t *testing.T,
+	handler dmimpl.DefaultDiscoveryHandler,
+	multicast discovery.MulticastOptions,
+	requesterIp string) []discomodel.DiscoveredTarget {
+
+	port := freeUdpPort(t)
+	stop := make(chan int)
+	stopped := make(chan struct{})
+
+	agent := discovery.DiscoveryAgent{DiscoveryServerPort: port,
+		StopDiscoveryServer: stop,
+		ServerTimeout:       time.Millisecond * 100,
+		Multicast:           multicast}
+
+	if connection, e := agent.GetServerUdpConnection(); e != nil {
+		t.Skip("Multicast is not available: " + e.Error())
+	} else {
+		connection.Close()
+	}
+
+	go func() {
+		agent.StartDiscoveryServer(handler)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	result, e := discovery.Discover(ctx, discovery.DiscoverOptions{TargetServerPort: port,
+		RequesterIp: requesterIp,
+		Multicast:   multicast})
+
+	if e != nil {
+		t.Fatal("Discover returned error: " + e.Error())
+	}
+	return result
+}
+
+func TestDiscover_Multicast(t *testing.T) {
+	result := discoverOverMulticast(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"},
+		discovery.MulticastOptions{Group: discomodel.DEFAULT_MULTICAST_GROUP}, "127.0.0.1")
+
+	if len(result) != 1 || result[0].Ip != "10.1.2.3" || result[0].Port != 8080 {
+		t.Errorf("Discover() == %v, wanted a single target 10.1.2.3:8080 over multicast", result)
+	}
+}
+
+func TestDiscover_MulticastIpv6(t *testing.T) {
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "fd00::5", AppIps: []string{"10.1.2.3"}, AppPort: "8080"}
+	result := discoverOverMulticast(t, handler,
+		discovery.MulticastOptions{Group: discomodel.DEFAULT_MULTICAST_GROUP_IPV6}, "::1")
+
+	if len(result) != 1 || result[0].Ip != "fd00::5" || len(result[0].Ips) != 2 || result[0].Ips[1] != "10.1.2.3" {
+		t.Errorf("Discover() == %v, wanted a single dual-stack target fd00::5 over ipv6 multicast", result)
+	}
+}
+
+func TestDiscover_DirectedBroadcast(t *testing.T) {
+	if broadcastIps, e := utils.DirectedBroadcastIps(nil, nil); e != nil || len(broadcastIps) == 0 {
+		t.Skip("Directed broadcast is not available, host has no broadcast capable interface")
+	}
+
+	port := freeUdpPort(t)
+	stop := make(chan int)
+	stopped := make(chan struct{})
+
+	agent := discovery.DiscoveryAgent{DiscoveryServerPort: port,
+		StopDiscoveryServer: stop,
+		ServerTimeout:       time.Millisecond * 100}
+
+	go func() {
+		agent.StartDiscoveryServer(dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"})
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	result, e := discovery.Discover(ctx, discovery.DiscoverOptions{TargetServerPort: port,
+		RequesterIp:       "127.0.0.1",
+		DirectedBroadcast: discovery.DirectedBroadcastOptions{Enabled: true}})
+
+	if e != nil {
+		t.Fatal("Discover over directed broadcast returned error: " + e.Error())
+	}
+
+	if len(result) != 1 || result[0].Ip != "10.1.2.3" {
+		t.Errorf("Discover() == %v, wanted a single target 10.1.2.3:8080 over directed broadcast", result)
+	}
+
+	_, e = discovery.Discover(context.Background(), discovery.DiscoverOptions{TargetServerPort: port,
+		RequesterIp:       "127.0.0.1",
+		DirectedBroadcast: discovery.DirectedBroadcastOptions{Enabled: true, Include: []string{"no-such-interface"}}})
+
+	if e == nil {
+		t.Error("Expected error when no interface is selected")
+	}
+}
+
+func TestDiscoveryAgent_ReplyToSourceAddress(t *testing.T) {
+	port := freeUdpPort(t)
+	stop := make(chan int)
+	stopped := make(chan struct{})
+
+	agent := discovery.DiscoveryAgent{DiscoveryServerPort: port,
+		StopDiscoveryServer: stop,
+		ServerTimeout:       time.Millisecond * 100}
+
+	go func() {
+		agent.StartDiscoveryServer(dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"})
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	connection, e := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal("Error creating requester connection: " + e.Error())
+	}
+	defer connection.Close()
+
+	// request points to an address nobody listens on, reply has to come back to connection anyway
+	requester := discovery.DiscoveryAgent{DiscoveryServerPort: freeUdpPort(t), BroadcastIp: "127.0.0.1"}
+	request, e := requester.BuildEncryptedDefaultDiscoveryRequest("192.0.2.99")
+	if e != nil {
+		t.Fatal("Error building discovery request: " + e.Error())
+	}
+
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1",
+		DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+
+	if e := requester.SendDiscoveryMessageFrom(connection, handler, request, port); e != nil {
+		t.Fatal("Error sending discovery request: " + e.Error())
+	}
+
+	connection.SetDeadline(time.Now().Add(time.Second))
+	if e := handler.HandleDataFromPacketConnection(connection); e != nil {
+		t.Fatal("Expected reply on the connection the request was sent from: " + e.Error())
+	}
+
+	select {
+	case target := <-handler.DiscoveredTargets:
+		if target.Ip != "10.1.2.3" || target.Port != 8080 {
+			t.Errorf("Expected target 10.1.2.3:8080, actual: %v", target)
+		}
+	default:
+		t.Error("Expected reply to be a discovery package")
+	}
+}
+
+func TestDiscoveryAgent_ClassicRequest(t *testing.T) {
+	responderPort, stopResponder := startLocalServer(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"})
+	defer stopResponder()
+
+	// requester collects replies with its own discovery server, they are sent to RequesterIp and RequesterPort
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", DiscoveredTargets: make(chan discomodel.DiscoveredTarget, 1)}
+	requesterPort, stopRequester := startLocalServer(t, handler)
+	defer stopRequester()
+
+	requester := discovery.DiscoveryAgent{DiscoveryServerPort: requesterPort, BroadcastIp: "127.0.0.1"}
+	request, e := requester.BuildEncryptedDefaultDiscoveryRequest("127.0.0.1")
+	if e != nil {
+		t.Fatal("Error building discovery request: " + e.Error())
+	}
+
+	if e := requester.BroadcastDiscoveryMessage(handler, request, responderPort); e != nil {
+		t.Fatal("Error sending discovery request: " + e.Error())
+	}
+
+	select {
+	case target := <-handler.DiscoveredTargets:
+		if target.Ip != "10.1.2.3" || target.Port != 8080 {
+			t.Errorf("Expected target 10.1.2.3:8080, actual: %v", target)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected reply on the discovery server of the requester")
+	}
+}
+
+func TestDiscover_IgnoresResponsesToOtherRequests(t *testing.T) {
+	listenPort := freeUdpPort(t)
+	s := new(security.Security)
+	token, e := s.GenerateDiscoReqToken()
+	if e != nil {
+		t.Fatal("Error generating token: " + e.Error())
+	}
+
+	// late response to an earlier request, sent to the port discover collects on
+	stale, e := s.SealDiscoveryPkg(discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE,
+		PkgValidation: token,
+		InstanceId:    "stale-instance",
+		RequestId:     "0123456789abcdef",
+		Records:       []discomodel.ServiceRecord{{Ip: "10.9.9.9", Port: "9090"}}})
+	if e != nil {
+		t.Fatal("Error sealing stale response: " + e.Error())
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		connection, e := net.Dial("udp", "127.0.0.1:"+listenPort)
+		if e != nil {
+			return
+		}
+		defer connection.Close()
+
+		for {
+			connection.Write(stale.Sealed)
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 20):
+			}
+		}
+	}()
+
+	result, e := discoverLocalService(t, dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"},
+		discovery.DiscoverOptions{ListenPort: listenPort})
+
+	if e != nil {
+		t.Fatal("Discover returned error: " + e.Error())
+	}
+
+	if len(result) != 1 || result[0].Ip != "10.1.2.3" || result[0].RequestId == "" {
+		t.Errorf("Discover() == %v, wanted only target 10.1.2.3:8080 answering its own request", result)
+	}
+}
+
+func TestDiscover_SameHost(t *testing.T) {
+	// RequesterIp of the request is 127.0.0.1 as well
+	result, e := discoverLocalService(t, dmimpl.DefaultDiscoveryHandler{AppIp: "127.0.0.1", AppPort: "8080"},
+		discovery.DiscoverOptions{})
+
+	if e != nil || len(result) != 1 || result[0].Ip != "127.0.0.1" || result[0].Port != 8080 {
+		t.Errorf("Discover() of a server on the same host == %v, %v, wanted target 127.0.0.1:8080", result, e)
+	}
+}
+
+func TestDiscover_KnownAnswers(t *testing.T) {
+	services := dmimpl.NewServiceSet()
+	services.AddService(discomodel.ServiceRecord{ServiceType: "_metrics._tcp", InstanceName: "web", Port: "9100"})
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080", ServiceType: "_http._tcp",
+		InstanceName: "web", InstanceId: "known-instance", Services: services}
+
+	knownHttp := discomodel.KnownAnswer{InstanceId: "known-instance", ServiceType: "_http._tcp", InstanceName: "web"}
+	knownMetrics := discomodel.KnownAnswer{InstanceId: "known-instance", ServiceType: "_metrics._tcp", InstanceName: "web"}
+	otherHttp := discomodel.KnownAnswer{InstanceId: "other-instance", ServiceType: "_http._tcp", InstanceName: "web"}
+
+	result, e := discoverLocalService(t, handler,
+		discovery.DiscoverOptions{KnownAnswers: []discomodel.KnownAnswer{otherHttp, knownHttp, knownMetrics}})
+
+	if e != nil || len(result) != 0 {
+		t.Errorf("Discover() with all services known == %v, %v, wanted no targets", result, e)
+	}
+
+	result, e = discoverLocalService(t, handler,
+		discovery.DiscoverOptions{KnownAnswers: []discomodel.KnownAnswer{knownHttp}, MaxJitter: time.Millisecond * 200})
+
+	if e != nil || len(result) != 1 || result[0].Id != "known-instance" || result[0].Port != 9100 {
+		t.Errorf("Discover() with http service known == %v, %v, wanted only metrics target of known-instance", result, e)
+	}
+
+	result, e = discoverLocalService(t, handler,
+		discovery.DiscoverOptions{KnownAnswers: []discomodel.KnownAnswer{otherHttp}})
+
+	if e != nil || len(result) != 2 {
+		t.Errorf("Discover() with other known instance == %v, %v, wanted both targets of known-instance", result, e)
+	}
+}
+
+func TestDiscoveryAgent_KnownAnswersOverBudget(t *testing.T) {
+	knownAnswers := make([]discomodel.KnownAnswer, 200)
+	for i := range knownAnswers {
+		knownAnswers[i] = discomodel.KnownAnswer{InstanceId: strconv.Itoa(i) + "-0123456789abcdef0123456789abcdef",
+			ServiceType: "_http._tcp", InstanceName: "web"}
+	}
+
+	agent := discovery.DiscoveryAgent{}
+	request, e := agent.BuildEncryptedDiscoveryQuery("127.0.0.1", discovery.DiscoveryQuery{KnownAnswers: knownAnswers})
+
+	if e != nil {
+		t.Fatal("Expected known answers over budget to be left out, actual error: " + e.Error())
+	}
+
+	if len(request.Sealed) == 0 || len(request.Sealed) > discomodel.DISCOVERY_PKG_BUDGET {
+		t.Errorf("Expected sealed request within budget, actual size %d", len(request.Sealed))
+	}
+}
+
+// drops the first datagram it receives, like a lossy network would
+type lossyHandler struct {
+	dmimpl.DefaultDiscoveryHandler
+	dropped *int32
+}
+
+func (this lossyHandler) ReceiveDataFromPacketConnection(connection net.PacketConn) error {
+	if atomic.LoadInt32(this.dropped) == 0 {
+		buffer := make([]byte, discomodel.MAX_DATAGRAM_SIZE)
+		_, _, e := connection.ReadFrom(buffer)
+		if e == nil {
+			atomic.StoreInt32(this.dropped, 1)
+		}
+		return e
+	}
+	return this.DefaultDiscoveryHandler.ReceiveDataFromPacketConnection(connection)
+}
+
+func TestDiscover_Retransmit(t *testing.T) {
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"}
+	retransmit := discovery.RetransmitOptions{Count: 2, Interval: time.Millisecond * 50}
+
+	result, e := discoverLocalService(t, handler, discovery.DiscoverOptions{Retransmit: retransmit, MaxJitter: time.Millisecond})
+
+	if e != nil || len(result) != 1 || result[0].RoundsSeen != 3 {
+		t.Errorf("Discover() with 2 retransmissions == %v, %v, wanted a single target seen in 3 rounds", result, e)
+	}
+
+	retransmit.SuppressAnswered = true
+	result, e = discoverLocalService(t, handler, discovery.DiscoverOptions{Retransmit: retransmit, MaxJitter: time.Millisecond})
+
+	if e != nil || len(result) != 1 || result[0].RoundsSeen != 1 {
+		t.Errorf("Discover() suppressing answered targets == %v, %v, wanted a single target seen in 1 round", result, e)
+	}
+}
+
+func TestDiscover_RetransmitNegativeCount(t *testing.T) {
+	handler := dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"}
+
+	result, e := discoverLocalService(t, handler,
+		discovery.DiscoverOptions{Retransmit: discovery.RetransmitOptions{Count: -1}, MaxJitter: time.Millisecond})
+
+	if e != nil || len(result) != 1 || result[0].RoundsSeen != 1 {
+		t.Errorf("Discover() with negative retransmission count == %v, %v, wanted a single target seen in 1 round", result, e)
+	}
+}
+
+func TestDiscover_RetransmitLostRequest(t *testing.T) {
+	handler := lossyHandler{DefaultDiscoveryHandler: dmimpl.DefaultDiscoveryHandler{AppIp: "10.1.2.3", AppPort: "8080"},
+		dropped: new(int32)}
+
+	result, e := discoverLocalHandler(t, handler, nil,
+		discovery.DiscoverOptions{Retransmit: discovery.RetransmitOptions{Count: 1, Interval: time.Millisecond * 50}})
+
+	if e != nil || len(result) != 1 || result[0].Ip != "10.1.2.3" || result[0].RoundsSeen != 1 {
+		t.Errorf("Discover() with lost first request == %v, %v, wanted target 10.1.2.3:8080 seen in 1 round", result, e)
+	}
+}
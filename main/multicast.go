@@ -0,0 +1,156 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/utils"
+)
+
+/*
+	multicast instead of the limited broadcast, empty Group keeps using broadcast.
+	Group - ipv4 or ipv6 multicast group, e.g. discomodel.DEFAULT_MULTICAST_GROUP (239.255.66.66)
+	or discomodel.DEFAULT_MULTICAST_GROUP_IPV6 (ff02::6666)
+	Interfaces - names of the interfaces the group is joined and sent on, default is
+	the interface chosen by the system, or all the multicast interfaces for link local ipv6
+	groups, which are sent with the interface as zone
+	Ttl - number of hops (hop limit for ipv6) packets may take, default utils.DEFAULT_MULTICAST_TTL (local network only)
+	DisableLoopback - do not deliver own packets to listeners on the sending host
+*/
+type MulticastOptions struct {
+	Group           string
+	Interfaces      []string
+	Ttl             int
+	DisableLoopback bool
+}
+
+func (this MulticastOptions) IsEnabled() bool {
+	return this.Group != ""
+}
+
+// true if group is an ipv6 group
+func (this MulticastOptions) IsIpv6() bool {
+	group := net.ParseIP(this.Group)
+	return group != nil && group.To4() == nil
+}
+
+// udp4 or udp6, depending on group
+func (this MulticastOptions) network() string {
+	if this.IsIpv6() {
+		return discomodel.CONNECTION_TYPE_UDP + "6"
+	}
+	return discomodel.CONNECTION_TYPE_UDP + "4"
+}
+
+// resolves group and interfaces
+func (this MulticastOptions) resolve() (net.IP, []*net.Interface, error) {
+	group := net.ParseIP(this.Group)
+	if group == nil || !group.IsMulticast() {
+		return nil, nil, errors.New("Error: " + this.Group + " is not a multicast group")
+	}
+
+	var interfaces []*net.Interface
+	var e error
+	if len(this.Interfaces) == 0 && this.IsIpv6() && group.IsLinkLocalMulticast() {
+		// link local group has a scope of its own on every interface, there is no system default
+		interfaces, e = utils.UpMulticastInterfaces()
+	} else {
+		interfaces, e = utils.MulticastInterfaces(this.Interfaces)
+	}
+
+	if e != nil {
+		return nil, nil, e
+	}
+
+	return group, interfaces, nil
+}
+
+// listens on port for packets sent to the group on all the interfaces
+func (this MulticastOptions) listen(port int) (*net.UDPConn, error) {
+	group, interfaces, e := this.resolve()
+	if e != nil {
+		return nil, e
+	}
+
+	connection, e := net.ListenMulticastUDP(this.network(), interfaces[0], &net.UDPAddr{IP: group, Port: port})
+	if e != nil {
+		return nil, errors.New("Error listening on multicast group: " + e.Error())
+	}
+
+	for _, ifi := range interfaces[1:] {
+		if e := utils.JoinMulticastGroup(connection, group, ifi); e != nil {
+			connection.Close()
+			return nil, e
+		}
+	}
+
+	return connection, nil
+}
+
+// address of the group on interface, link local ipv6 groups are sent with the interface as zone
+func (this MulticastOptions) groupAddr(group net.IP, ifi *net.Interface, port int) *net.UDPAddr {
+	groupAddr := &net.UDPAddr{IP: group, Port: port}
+	if ifi != nil && group.IsLinkLocalMulticast() && this.IsIpv6() {
+		groupAddr.Zone = ifi.Name
+	}
+	return groupAddr
+}
+
+// opens one sending connection to the group per interface
+func (this MulticastOptions) dial(port int) ([]*net.UDPConn, error) {
+	group, interfaces, e := this.resolve()
+	if e != nil {
+		return nil, e
+	}
+
+	result := make([]*net.UDPConn, 0, len(interfaces))
+	for _, ifi := range interfaces {
+		connection, e := net.DialUDP(this.network(), nil, this.groupAddr(group, ifi, port))
+
+		if e == nil {
+			e = utils.SetMulticastOptions(connection, ifi, this.Ttl, !this.DisableLoopback)
+			if e != nil {
+				connection.Close()
+			}
+		}
+
+		if e != nil {
+			for _, opened := range result {
+				opened.Close()
+			}
+			return nil, errors.New("Error connecting to multicast group: " + e.Error())
+		}
+
+		result = append(result, connection)
+	}
+
+	return result, nil
+}
+
+// sends to the group on every interface from connection, which is not connected to the group
+// send is called once per interface, with the address of the group
+func (this MulticastOptions) sendFrom(connection *net.UDPConn, port int, send func(address net.Addr) error) error {
+	group, interfaces, e := this.resolve()
+	if e != nil {
+		return e
+	}
+
+	var strBldr bytes.Buffer
+	for _, ifi := range interfaces {
+		e := utils.SetMulticastSendOptions(connection, group, ifi, this.Ttl, !this.DisableLoopback)
+		if e == nil {
+			e = send(this.groupAddr(group, ifi, port))
+		}
+
+		if e != nil {
+			strBldr.WriteString("\tError sending to multicast group: " + e.Error() + "\n")
+		}
+	}
+
+	if strBldr.Len() > 0 {
+		return errors.New("Error while multicasting discovery message:\n" + strBldr.String())
+	}
+	return nil
+}
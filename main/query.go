@@ -0,0 +1,42 @@
+package discovery
+
+import (
+	"time"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+)
+
+/*
+	describes a discovery request, all attrs are optional
+	Filter - service type and instance name to look for, default is any service
+	RequestId - echoed in every response to the request, default is a new id from NewRequestId
+	MaxJitter - responders wait a random time up to MaxJitter before answering, so replies of
+	many responders are spread over time instead of arriving all at once. default is no jitter,
+	responders never wait longer than discomodel.MAX_RESPONSE_JITTER
+	KnownAnswers - targets the requester already knows, they do not answer, other services of
+	the same agents still do. answers that do not fit into the package are left out, those targets
+	answer as usual
+	ReplyToSource - responders answer to the source address of the request instead of RequesterIp
+	and RequesterPort, set it only when the replies are read from the socket the request is sent
+	from, see DiscoveryAgent.SendDiscoveryMessageFrom which sets it on its own
+*/
+type DiscoveryQuery struct {
+	Filter           discomodel.ServiceFilter
+	RequestId        string
+	MaxJitter        time.Duration
+	KnownAnswers  []discomodel.KnownAnswer
+	ReplyToSource bool
+}
+
+// max jitter in whole milliseconds, as it is sent in discomodel.DiscoveryPkg
+func (this DiscoveryQuery) maxJitterMillis() int64 {
+	if this.MaxJitter <= 0 {
+		return 0
+	}
+
+	millis := int64(this.MaxJitter / time.Millisecond)
+	if millis == 0 {
+		return 1
+	}
+	return millis
+}
@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"time"
+)
+
+const (
+	DEFAULT_RETRANSMIT_INTERVAL = time.Millisecond * 250
+	DEFAULT_RETRANSMIT_BACKOFF  = 2.0
+)
+
+/*
+	retransmission of the discovery request within one discovery round, so a single lost
+	datagram on a lossy network does not mean an empty result. replies to all the requests
+	are merged, discomodel.DiscoveredTarget.RoundsSeen says how many of them a target answered.
+	Count - number of retransmissions after the first request, default is none
+	Interval - time between the first request and the first retransmission, default DEFAULT_RETRANSMIT_INTERVAL
+	Backoff - factor every following interval is multiplied by, default DEFAULT_RETRANSMIT_BACKOFF,
+	e.g. retransmissions 250ms, 750ms and 1750ms after the first request for Count 3.
+	retransmissions that would be sent after the end of the round are not sent
+	SuppressAnswered - retransmissions list targets that already answered as known answers,
+	so they stay silent. it saves traffic, but RoundsSeen of those targets stays 1
+*/
+type RetransmitOptions struct {
+	Count            int
+	Interval         time.Duration
+	Backoff          float64
+	SuppressAnswered bool
+}
+
+// returns time to wait before every retransmission, counted from the previous request
+func (this RetransmitOptions) schedule() []time.Duration {
+	if this.Count <= 0 {
+		return nil
+	}
+
+	interval := this.Interval
+	if interval <= 0 {
+		interval = DEFAULT_RETRANSMIT_INTERVAL
+	}
+
+	backoff := this.Backoff
+	if backoff < 1 {
+		backoff = DEFAULT_RETRANSMIT_BACKOFF
+	}
+
+	result := make([]time.Duration, 0, this.Count)
+	for i := 0; i < this.Count; i++ {
+		result = append(result, interval)
+		interval = time.Duration(float64(interval) * backoff)
+	}
+	return result
+}
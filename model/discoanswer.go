@@ -0,0 +1,19 @@
+package discomodel
+
+/*
+	a target the requester already knows, sent in requests so the target does not answer again.
+	a target is identified by the instance id of its agent and by its service type and instance name,
+	see DiscoveredTarget.Identity, so other services of the same agent still answer
+*/
+type KnownAnswer struct {
+	InstanceId   string
+	ServiceType  string
+	InstanceName string
+}
+
+// checks if record announced by agent with given instance id is the known target
+func (this KnownAnswer) Matches(instanceId string, record ServiceRecord) bool {
+	return this.InstanceId == instanceId &&
+		this.ServiceType == record.ServiceType &&
+		this.InstanceName == record.InstanceName
+}
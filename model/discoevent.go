@@ -0,0 +1,83 @@
+package discomodel
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// types of TargetEvent
+// TARGET_REMOVED is sent when the target said goodbye or was removed, TARGET_EXPIRED when its ttl lapsed
+const (
+	TARGET_ADDED = 20 + iota
+	TARGET_UPDATED
+	TARGET_REMOVED
+	TARGET_EXPIRED
+)
+
+/*
+	change of a target in a registry.
+	Previous and Changes are set for TARGET_UPDATED only,
+	Changes holds names of the DiscoveredTarget attrs that differ, see DiffTargets
+*/
+type TargetEvent struct {
+	Type     int
+	Target   DiscoveredTarget
+	Previous DiscoveredTarget
+	Changes  []string
+}
+
+func (this TargetEvent) String() string {
+	return fmt.Sprintf("Type: %d\nChanges: %v\nTarget: %v", this.Type, this.Changes, this.Target)
+}
+
+// returns names of the attrs that differ between previous and current target
+// LastSeen, RequestId and RoundsSeen are left out, they change every time the target is refreshed
+func DiffTargets(previous DiscoveredTarget, current DiscoveredTarget) []string {
+	changes := make([]string, 0)
+
+	if previous.Id != current.Id {
+		changes = append(changes, "Id")
+	}
+
+	if previous.Ip != current.Ip {
+		changes = append(changes, "Ip")
+	}
+
+	if !reflect.DeepEqual(previous.Ips, current.Ips) {
+		changes = append(changes, "Ips")
+	}
+
+	if previous.Port != current.Port {
+		changes = append(changes, "Port")
+	}
+
+	if previous.Alias != current.Alias {
+		changes = append(changes, "Alias")
+	}
+
+	if previous.ServiceType != current.ServiceType {
+		changes = append(changes, "ServiceType")
+	}
+
+	if previous.InstanceName != current.InstanceName {
+		changes = append(changes, "InstanceName")
+	}
+
+	if previous.Status != current.Status {
+		changes = append(changes, "Status")
+	}
+
+	if !reflect.DeepEqual(previous.Attributes, current.Attributes) {
+		changes = append(changes, "Attributes")
+	}
+
+	if !reflect.DeepEqual(previous.Payload, current.Payload) {
+		changes = append(changes, "Payload")
+	}
+
+	if previous.Ttl != current.Ttl {
+		changes = append(changes, "Ttl")
+	}
+
+	return changes
+}
@@ -0,0 +1,32 @@
+package discomodel
+
+import "strings"
+
+/*
+	what a requester is looking for, empty attrs match anything.
+	ServiceType - e.g. "_billing._tcp"
+	InstanceName - name of a single instance of the service
+	both are compared case insensitive
+*/
+type ServiceFilter struct {
+	ServiceType  string
+	InstanceName string
+}
+
+// checks if service with given type and instance name is what the filter is looking for
+func (this ServiceFilter) Matches(serviceType string, instanceName string) bool {
+	if this.ServiceType != "" && !strings.EqualFold(this.ServiceType, serviceType) {
+		return false
+	}
+
+	if this.InstanceName != "" && !strings.EqualFold(this.InstanceName, instanceName) {
+		return false
+	}
+
+	return true
+}
+
+// true if filter matches any service
+func (this ServiceFilter) IsEmpty() bool {
+	return this.ServiceType == "" && this.InstanceName == ""
+}
@@ -1,39 +1,187 @@
 package discomodel
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// DISCOVERY_ANNOUNCE is broadcast by a discovery server on start and then periodically,
+// DISCOVERY_GOODBYE when it stops. both carry the same records as DISCOVERY_PACKAGE
 const (
 	DISCOVERY_PACKAGE = 10 + iota
 	DISCOVERY_REQUEST
+	DISCOVERY_ANNOUNCE
+	DISCOVERY_GOODBYE
 )
 
 const (
 	CONNECTION_TYPE_UDP                       = "udp"
 	DISCOVERY_PORT                            = "6666"
 	BROADCAST_IP                              = "255.255.255.255"
+	// organization local scope group used when multicast is enabled without a group of its own
+	DEFAULT_MULTICAST_GROUP = "239.255.66.66"
+	// link local scope ipv6 group
+	DEFAULT_MULTICAST_GROUP_IPV6 = "ff02::6666"
 	DEFAULT_LOCAL_BROADCAST_CONNECTION_STRING = ":0"
 	DEFAULT_SEED_VALUE                        = "GMT"
+	// largest payload a single udp datagram can carry
+	MAX_DATAGRAM_SIZE = 65507
+	// sealed discovery packages have to fit into this size, so they are not fragmented on ethernet
+	DISCOVERY_PKG_BUDGET = 1400
+	// how long a target is valid when its package does not say it
+	DEFAULT_TTL = time.Second * 120
+	// responders never wait longer than this before answering, whatever the request asks for
+	MAX_RESPONSE_JITTER = time.Second * 2
 )
 
+/*
+	Sealed carries the whole package sealed by security.Security as a binary envelope frame,
+	in that case all the other attrs are empty and only the frame is sent over the wire.
+	Timestamp (unix nano) and Nonce are used to detect replayed packages.
+	Signature is an ed25519 signature of SignedContent made by key SignerKeyId.
+	Payload is a custom value marshaled by dminterface.PayloadCodec.
+	Attributes are TXT record like key/value pairs describing the service, e.g. version=2.
+	ServiceType and InstanceName are the ServiceFilter of the requester in requests.
+	RequesterIp is the app ip of the sender in announcements and goodbyes.
+	InstanceId is the stable id of the sending agent in responses, announcements and goodbyes.
+	RequestId is a random id of a request, echoed in every response to it, so the requester
+	can tell which of its requests a response answers. empty in announcements and goodbyes.
+	MaxJitter is the number of milliseconds responders wait at most before answering a request,
+	each responder waits a random time, so replies of many responders do not arrive all at once.
+	KnownAnswers are targets the requester already knows, they do not answer the request.
+	ReplyToSource is set in requests of requesters receiving the replies on the socket they sent
+	the request from, responders answer to the source address of the request then instead of
+	RequesterIp and RequesterPort.
+	Ttl is the number of seconds targets described by the package stay valid, 0 in goodbyes.
+	when a response or announcement has no Ttl (legacy cfb mode), DEFAULT_TTL is used.
+	Records hold all the services announced in a response, when Records are empty
+	(legacy cfb mode) the service is described by the App* attrs
+*/
 type DiscoveryPkg struct {
-	Type          int
-	PkgValidation string
-	AppServerIp   string
-	AppServerPort string
-	RequesterIp   string
-	RequesterPort string
-	Alias         string
+	Type             int
+	PkgValidation    string
+	AppServerIp      string
+	AppServerPort    string
+	RequesterIp      string
+	RequesterPort    string
+	Alias            string
+	ServiceType      string
+	InstanceName     string
+	InstanceId       string
+	RequestId        string
+	MaxJitter        int64
+	KnownAnswers     []KnownAnswer
+	ReplyToSource    bool
+	Records          []ServiceRecord
+	Payload          []byte
+	Attributes       map[string]string
+	Ttl              int64
+	Timestamp        int64
+	Nonce            string
+	SignerKeyId      string
+	Signature        []byte
+	Sealed           []byte
 }
 
 func (this *DiscoveryPkg) String() string {
-	return fmt.Sprintf("Type: %d\nPKG Validation: %q\nLocal Server Ip: %q\nServer Port: %q\nLocal Requester Ip: %q\nLocal Requester Port: %q\nAlias: %q",
+	return fmt.Sprintf("Type: %d\nPKG Validation: %q\nLocal Server Ip: %q\nServer Port: %q\nLocal Requester Ip: %q\nLocal Requester Port: %q\nAlias: %q\nService Type: %q\nInstance Name: %q\nInstance Id: %q\nRequest Id: %q\nMax Jitter: %d\nKnown Answers: %v\nReply To Source: %t\nRecords: %v\nAttributes: %v\nTtl: %d\nTimestamp: %d\nNonce: %q",
 		this.Type,
 		this.PkgValidation,
 		this.AppServerIp,
 		this.AppServerPort,
 		this.RequesterIp,
 		this.RequesterPort,
-		this.Alias)
+		this.Alias,
+		this.ServiceType,
+		this.InstanceName,
+		this.InstanceId,
+		this.RequestId,
+		this.MaxJitter,
+		this.KnownAnswers,
+		this.ReplyToSource,
+		this.Records,
+		this.Attributes,
+		this.Ttl,
+		this.Timestamp,
+		this.Nonce)
+}
+
+// writes length prefixed value, so no two different packages produce the same content
+func writeSignedValue(buffer *bytes.Buffer, value []byte) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(value)))
+	buffer.Write(value)
+}
+
+// writes attributes sorted by key, map order is random
+func writeSignedAttributes(buffer *bytes.Buffer, attributes map[string]string) {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	binary.Write(buffer, binary.BigEndian, uint32(len(keys)))
+	for _, key := range keys {
+		writeSignedValue(buffer, []byte(key))
+		writeSignedValue(buffer, []byte(attributes[key]))
+	}
+}
+
+// checks attribute keys are not empty and do not contain '='
+func ValidateAttributes(attributes map[string]string) error {
+	for key := range attributes {
+		if key == "" || strings.Contains(key, "=") {
+			return errors.New("Error: invalid attribute key " + strconv.Quote(key))
+		}
+	}
+	return nil
+}
+
+// deterministic binary form of all the attrs covered by Signature, which are all but Signature and Sealed
+func (this *DiscoveryPkg) SignedContent() []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.BigEndian, int64(this.Type))
+	writeSignedValue(&buffer, []byte(this.PkgValidation))
+	writeSignedValue(&buffer, []byte(this.AppServerIp))
+	writeSignedValue(&buffer, []byte(this.AppServerPort))
+	writeSignedValue(&buffer, []byte(this.RequesterIp))
+	writeSignedValue(&buffer, []byte(this.RequesterPort))
+	writeSignedValue(&buffer, []byte(this.Alias))
+	writeSignedValue(&buffer, []byte(this.ServiceType))
+	writeSignedValue(&buffer, []byte(this.InstanceName))
+	writeSignedValue(&buffer, []byte(this.InstanceId))
+	writeSignedValue(&buffer, []byte(this.RequestId))
+	binary.Write(&buffer, binary.BigEndian, this.MaxJitter)
+	binary.Write(&buffer, binary.BigEndian, uint32(len(this.KnownAnswers)))
+	for _, knownAnswer := range this.KnownAnswers {
+		writeSignedValue(&buffer, []byte(knownAnswer.InstanceId))
+		writeSignedValue(&buffer, []byte(knownAnswer.ServiceType))
+		writeSignedValue(&buffer, []byte(knownAnswer.InstanceName))
+	}
+	binary.Write(&buffer, binary.BigEndian, this.ReplyToSource)
+	binary.Write(&buffer, binary.BigEndian, uint32(len(this.Records)))
+	for _, record := range this.Records {
+		writeSignedValue(&buffer, []byte(record.ServiceType))
+		writeSignedValue(&buffer, []byte(record.InstanceName))
+		writeSignedValue(&buffer, []byte(record.Ip))
+		writeSignedValue(&buffer, []byte(record.Port))
+		binary.Write(&buffer, binary.BigEndian, uint32(len(record.Ips)))
+		for _, ip := range record.Ips {
+			writeSignedValue(&buffer, []byte(ip))
+		}
+		writeSignedAttributes(&buffer, record.Attributes)
+	}
+	writeSignedValue(&buffer, this.Payload)
+	writeSignedAttributes(&buffer, this.Attributes)
+	binary.Write(&buffer, binary.BigEndian, this.Ttl)
+	binary.Write(&buffer, binary.BigEndian, this.Timestamp)
+	writeSignedValue(&buffer, []byte(this.Nonce))
+	writeSignedValue(&buffer, []byte(this.SignerKeyId))
+	return buffer.Bytes()
 }
@@ -0,0 +1,28 @@
+package discomodel
+
+import "fmt"
+
+/*
+	one service announced by a discovery agent.
+	an agent may announce several services, e.g. http, grpc and metrics ports of one process.
+	ServiceType and InstanceName identify the service within the agent.
+	Ips are further addresses of the service, e.g. ipv6 address of a dual-stack agent
+*/
+type ServiceRecord struct {
+	ServiceType  string
+	InstanceName string
+	Ip           string
+	Port         string
+	Ips          []string
+	Attributes   map[string]string
+}
+
+func (this ServiceRecord) String() string {
+	return fmt.Sprintf("Service Type: %q\nInstance Name: %q\nIp: %q\nPort: %q\nIps: %v\nAttributes: %v",
+		this.ServiceType,
+		this.InstanceName,
+		this.Ip,
+		this.Port,
+		this.Ips,
+		this.Attributes)
+}
@@ -1,20 +1,89 @@
 package discomodel
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
 
+/*
+	Status lifecycle of a target:
+	discovered - a response or announcement of the target was received
+	healthy, unhealthy - set by a health checker probing the target
+	expired - ttl of the target lapsed without hearing from it again
+	left - target said goodbye
+*/
+const (
+	TARGET_STATUS_DISCOVERED = "discovered"
+	TARGET_STATUS_HEALTHY    = "healthy"
+	TARGET_STATUS_UNHEALTHY  = "unhealthy"
+	TARGET_STATUS_EXPIRED    = "expired"
+	TARGET_STATUS_LEFT       = "left"
+)
+
+// Id is the stable instance id of the agent announcing the target, it stays the same
+// across restarts and ip changes of the agent. empty for agents in legacy cfb mode
+// Payload holds custom payload of the target, its model is defined by dminterface.PayloadCodec
+// Attributes are key/value pairs the target announced about itself
+// target is valid for Ttl since LastSeen, see ExpiresAt
+// Ips holds all the addresses of the target, Ip first, e.g. ipv4 and ipv6 address of a dual-stack agent
+// RequestId is the id of the request the target answered, empty when the target was announced
+// RoundsSeen is the number of requests of one discovery round the target answered, set by Discover only
 type DiscoveredTarget struct {
-	Id    int
-	Ip    string
-	Port  int
-	Alias string
-	Status string
+	Id           string
+	Ip           string
+	Ips          []string
+	Port         int
+	Alias        string
+	ServiceType  string
+	InstanceName string
+	Status       string
+	Attributes   map[string]string
+	Payload      interface{}
+	Ttl          time.Duration
+	LastSeen     time.Time
+	RequestId    string
+	RoundsSeen   int
 }
 
 func (this DiscoveredTarget) String() string {
-	return fmt.Sprintf("\n==== Discovered Target Info ====\nId:\t%d\nIP address:\t%q\nPort:\t%d\nAlias:\t%q\nStatus: %q\n",
+	return fmt.Sprintf("\n==== Discovered Target Info ====\nId:\t%q\nIP address:\t%q\nIP addresses:\t%v\nPort:\t%d\nAlias:\t%q\nService Type:\t%q\nInstance Name:\t%q\nStatus: %q\nAttributes:\t%v\nPayload:\t%v\nTtl:\t%v\nLast Seen:\t%v\nRequest Id:\t%q\nRounds Seen:\t%d\n",
 		this.Id,
 		this.Ip,
+		this.Ips,
 		this.Port,
 		this.Alias,
-		this.Status)
+		this.ServiceType,
+		this.InstanceName,
+		this.Status,
+		this.Attributes,
+		this.Payload,
+		this.Ttl,
+		this.LastSeen,
+		this.RequestId,
+		this.RoundsSeen)
+}
+
+// identifies the same service of the same agent across packages
+// targets without Id are identified by their address and alias
+func (this DiscoveredTarget) Identity() string {
+	if this.Id != "" {
+		return this.Id + "/" + this.ServiceType + "/" + this.InstanceName
+	}
+	return net.JoinHostPort(this.Ip, strconv.Itoa(this.Port)) + "/" + this.Alias + "/" + this.ServiceType + "/" + this.InstanceName
+}
+
+// known answer describing the target, targets without Id can not be known answers
+func (this DiscoveredTarget) KnownAnswer() KnownAnswer {
+	return KnownAnswer{InstanceId: this.Id, ServiceType: this.ServiceType, InstanceName: this.InstanceName}
+}
+
+func (this DiscoveredTarget) ExpiresAt() time.Time {
+	return this.LastSeen.Add(this.Ttl)
+}
+
+// target is expired when its ttl lapsed or it said goodbye
+func (this DiscoveredTarget) IsExpired(now time.Time) bool {
+	return this.Status == TARGET_STATUS_LEFT || this.Status == TARGET_STATUS_EXPIRED || !now.Before(this.ExpiresAt())
 }
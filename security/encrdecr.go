@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"errors"
 	"math/rand"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,14 +16,96 @@ import (
 	"github.com/sanitizer/discovery/model"
 )
 
+/*
+	keyring holds the pre-shared keys used for encryption, only agents sharing a key
+	can read each other packets. use NewSecurity, NewSecurityFromFile or NewSecurityFromEnv
+	to set a single key or NewSecurityWithKeyring to share a keyring that allows key rotation.
+	if no key is set, the library wide DEFAULT_KEY is used, which every installation
+	of this lib knows, so it is only fine for trying things out.
+	packets are sealed with AES-GCM, see seal.go. LegacyCFB switches back to the
+	old per field CFB encryption, which has no integrity protection and should only
+	be used to talk to agents running an older version of this lib.
+	Offset (seconds) and SeedValue are the time zone offset and name of legacy cfb mode token,
+	both are ignored otherwise, as the default token does not depend on any time zone.
+	when SigningKey is set, sealed packages are signed with it. when TrustedKeys are set,
+	discovery packages not signed by one of them are dropped, see signing.go
+*/
 type Security struct {
-	SeedValue string
-	Offset    int
+	SeedValue   string
+	Offset      int
+	LegacyCFB   bool
+	SigningKey  ed25519.PrivateKey
+	TrustedKeys TrustedKeys
+	keyring     *Keyring
 }
 
 const PATTERN = "//"
 const PATTERN_REGEX = "//[0-9]*//"
 
+// key that was hardcoded in the lib before keys became configurable
+const DEFAULT_KEY = "IwTbLbY!0@9*7^JyTtPtWyPmPmDyPmMf"
+
+// environment variable NewSecurityFromEnv reads the key from, when no name is given
+const DEFAULT_KEY_ENV_VARIABLE = "DISCOVERY_KEY"
+
+// creates security using given pre-shared key. key length has to be 16, 24 or 32 bytes
+func NewSecurity(key []byte) (*Security, error) {
+	keyring, e := NewKeyring(key)
+	if e != nil {
+		return nil, e
+	}
+
+	return NewSecurityWithKeyring(keyring), nil
+}
+
+// creates security using keyring. agent and handler sharing a keyring see the same key changes
+func NewSecurityWithKeyring(keyring *Keyring) *Security {
+	return &Security{SeedValue: discomodel.DEFAULT_SEED_VALUE, keyring: keyring}
+}
+
+// reads pre-shared key from a file. leading and trailing white spaces are ignored
+func NewSecurityFromFile(path string) (*Security, error) {
+	content, e := os.ReadFile(path)
+	if e != nil {
+		return nil, errors.New("Error reading key file: " + e.Error())
+	}
+
+	return NewSecurity(bytes.TrimSpace(content))
+}
+
+// reads pre-shared key from environment variable. if name is empty DEFAULT_KEY_ENV_VARIABLE is used
+func NewSecurityFromEnv(name string) (*Security, error) {
+	if name == "" {
+		name = DEFAULT_KEY_ENV_VARIABLE
+	}
+
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, errors.New("Error: environment variable " + name + " with the key is not set")
+	}
+
+	return NewSecurity([]byte(value))
+}
+
+// returns keyring of security, nil if security uses the default key
+func (this *Security) Keyring() *Keyring {
+	return this.keyring
+}
+
+// returns keyring in use, falls back to keyring with DEFAULT_KEY if none was set
+func (this *Security) getKeyring() *Keyring {
+	if this == nil || this.keyring == nil {
+		return defaultKeyring
+	}
+	return this.keyring
+}
+
+// returns primary key in use
+func (this *Security) getKey() []byte {
+	_, key := this.getKeyring().Primary()
+	return key
+}
+
 // given by a code example(i do not know what that is and why is it here. need research)
 var commonIV = []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
 
@@ -33,10 +117,8 @@ var commonIV = []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09
 	(searchsecurity.techtarget.com/definition/ciphertext-feedback)
 */
 func (this *Security) EncryptCFB(plainText []byte) (string, error) {
-	key := "IwTbLbY!0@9*7^JyTtPtWyPmPmDyPmMf"
-
 	//Create aes encryption algorithm
-	c, err := aes.NewCipher([]byte(key))
+	c, err := aes.NewCipher(this.getKey())
 
 	if err != nil {
 		return "", err
@@ -56,10 +138,8 @@ func (this *Security) EncryptCFB(plainText []byte) (string, error) {
 	(searchsecurity.techtarget.com/definition/ciphertext-feedback)
 */
 func (this *Security) DecryptCFB(encryptedText []byte, dataLen int) (string, error) {
-	key := "IwTbLbY!0@9*7^JyTtPtWyPmPmDyPmMf"
-
 	//Create aes encryption algorithm
-	c, err := aes.NewCipher([]byte(key))
+	c, err := aes.NewCipher(this.getKey())
 
 	if err != nil {
 		return "", err
@@ -72,6 +152,7 @@ func (this *Security) DecryptCFB(encryptedText []byte, dataLen int) (string, err
 }
 
 // searches using regex for injected length of original encrypted data in encrypted string
+// only used by LegacyCFB mode, fails when cipher text itself contains the pattern. sealed packages use Envelope
 func (this *Security) FindLengthInCFBEncryptedString(encryptedData string) (string, error) {
 	re := regexp.MustCompile(PATTERN_REGEX)
 	result := re.FindAllStringSubmatch(encryptedData, -1)
@@ -84,12 +165,14 @@ func (this *Security) FindLengthInCFBEncryptedString(encryptedData string) (stri
 }
 
 // clears the pattern from the length that was injected into the encrypted string
+// only used by LegacyCFB mode
 func (this *Security) RemovePatternAttrsFromLength(length string) (int, error) {
 	result, err := strconv.Atoi(strings.Replace(length, PATTERN, "", 2))
 	return result, err
 }
 
 // injects length of original encrypted data into encrypted string
+// only used by LegacyCFB mode, sealed packages use Envelope
 func (this *Security) HideLengthInCFBEncryptedString(encryptedData string, originalLength int) string {
 	halfOfData := encryptedData[0:int(len(encryptedData)/2)]
 	result := strings.Replace(encryptedData, halfOfData, string(halfOfData+PATTERN+strconv.Itoa(originalLength)+PATTERN), 1)
@@ -97,18 +180,20 @@ func (this *Security) HideLengthInCFBEncryptedString(encryptedData string, origi
 }
 
 // removes the injected length of original encrypted data from encrypted string
+// only used by LegacyCFB mode
 func (this *Security) RemoveLengthFromCFBEncryptedData(encryptedData string, patternToRemove string) string {
 	return strings.Replace(encryptedData, patternToRemove, "", 1)
 }
 
+// security is shared between goroutines, so nothing is written to it here
 func (this *Security) generateDiscoReqTokenSeed() (int64, error) {
-
-	if this.SeedValue == "" {
-		this.SeedValue = discomodel.DEFAULT_SEED_VALUE
+	seedValue := this.SeedValue
+	if seedValue == "" {
+		seedValue = discomodel.DEFAULT_SEED_VALUE
 	}
 
 	var strBuilder bytes.Buffer
-	location := time.FixedZone(this.SeedValue, this.Offset)
+	location := time.FixedZone(seedValue, this.Offset)
 	tm := time.Now().In(location)
 
 	/*
@@ -124,13 +209,16 @@ func (this *Security) generateDiscoReqTokenSeed() (int64, error) {
 	return int64(result), e
 }
 
-func (this *Security) GenerateDiscoReqToken() (string, error) {
+// token used by LegacyCFB mode. value is derived from current date only, see token.go for the default one
+func (this *Security) generateLegacyDiscoReqToken() (string, error) {
 	seed, e := this.generateDiscoReqTokenSeed()
 
 	if e != nil {
 		return "", errors.New("Error generating seed for rand: " + e.Error())
 	}
 
-	rand.Seed(seed)
-	return strconv.Itoa(rand.Int()), nil
+	// a source of its own instead of seeding the global one: concurrent handlers would
+	// reseed and read the shared source in between each other. first value of a source is
+	// the same value rand.Int returned after rand.Seed, so old agents still accept the token
+	return strconv.Itoa(rand.New(rand.NewSource(seed)).Int()), nil
 }
@@ -0,0 +1,94 @@
+package security
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	// version of the envelope layout and of the sealing inside it (AES-GCM)
+	ENVELOPE_VERSION = 1
+	// version + key id + nonce length + payload length
+	ENVELOPE_HEADER_SIZE = 1 + 4 + 1 + 4
+	// key id and version are authenticated along with the payload
+	ENVELOPE_AUTHENTICATED_HEADER_SIZE = 1 + 4
+)
+
+/*
+	binary frame for sealed data. layout:
+	| version 1 byte | key id 4 bytes | nonce length 1 byte | nonce | payload length 4 bytes | payload |
+	numbers are big endian. payload is the sealed data, nonce is the one used to seal it.
+	unlike the //N// scheme of the cfb mode, the frame does not care what bytes the payload holds
+*/
+type Envelope struct {
+	Version byte
+	KeyId   uint32
+	Nonce   []byte
+	Payload []byte
+}
+
+// part of the frame that is authenticated as additional data when sealing
+func (this *Envelope) authenticatedHeader() []byte {
+	header := make([]byte, ENVELOPE_AUTHENTICATED_HEADER_SIZE)
+	header[0] = this.Version
+	binary.BigEndian.PutUint32(header[1:], this.KeyId)
+	return header
+}
+
+// writes envelope into its binary frame
+func EncodeEnvelope(envelope Envelope) ([]byte, error) {
+	if len(envelope.Nonce) > 0xff {
+		return nil, errors.New("Error encoding envelope: nonce is too long: " + strconv.Itoa(len(envelope.Nonce)))
+	}
+
+	if uint64(len(envelope.Payload)) > 0xffffffff {
+		return nil, errors.New("Error encoding envelope: payload is too long: " + strconv.Itoa(len(envelope.Payload)))
+	}
+
+	result := make([]byte, 0, ENVELOPE_HEADER_SIZE+len(envelope.Nonce)+len(envelope.Payload))
+	result = append(result, envelope.authenticatedHeader()...)
+	result = append(result, byte(len(envelope.Nonce)))
+	result = append(result, envelope.Nonce...)
+	result = binary.BigEndian.AppendUint32(result, uint32(len(envelope.Payload)))
+	result = append(result, envelope.Payload...)
+	return result, nil
+}
+
+// reads envelope from its binary frame. frames that are truncated, have trailing data
+// or an unknown version are rejected. returned nonce and payload are copies of the data
+func DecodeEnvelope(data []byte) (Envelope, error) {
+	if len(data) < ENVELOPE_HEADER_SIZE {
+		return Envelope{}, errors.New("Error decoding envelope: frame is too short")
+	}
+
+	envelope := Envelope{Version: data[0], KeyId: binary.BigEndian.Uint32(data[1:5])}
+
+	if envelope.Version != ENVELOPE_VERSION {
+		return Envelope{}, errors.New("Error decoding envelope: unsupported version " + strconv.Itoa(int(envelope.Version)))
+	}
+
+	rest := data[5:]
+	nonceLength := int(rest[0])
+	rest = rest[1:]
+
+	if len(rest) < nonceLength+4 {
+		return Envelope{}, errors.New("Error decoding envelope: frame is truncated")
+	}
+
+	envelope.Nonce = append([]byte{}, rest[:nonceLength]...)
+	rest = rest[nonceLength:]
+	payloadLength := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	if uint64(len(rest)) < uint64(payloadLength) {
+		return Envelope{}, errors.New("Error decoding envelope: frame is truncated")
+	}
+
+	if uint64(len(rest)) > uint64(payloadLength) {
+		return Envelope{}, errors.New("Error decoding envelope: unexpected data after payload")
+	}
+
+	envelope.Payload = append([]byte{}, rest...)
+	return envelope, nil
+}
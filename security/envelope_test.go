@@ -0,0 +1,103 @@
+package security_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/sanitizer/discovery/security"
+	"testing"
+)
+
+// payloads that would break the //N// length scheme of the cfb mode
+var envelopePayloads = [][]byte{
+	{},
+	[]byte("//5//"),
+	[]byte("abc//12//def//345//"),
+	{0x00, 0xff, '/', '/', '9', '/', '/', 0x00},
+	bytes.Repeat([]byte{0x00}, 1024),
+}
+
+func TestEncodeDecodeEnvelope(t *testing.T) {
+	randomPayload := make([]byte, 4096)
+	rand.Read(randomPayload)
+
+	for _, payload := range append(envelopePayloads, randomPayload) {
+		envelope := security.Envelope{Version: security.ENVELOPE_VERSION,
+			KeyId:   0xdeadbeef,
+			Nonce:   []byte("//1//nonce//"),
+			Payload: payload}
+
+		encoded, e := security.EncodeEnvelope(envelope)
+
+		if e != nil {
+			t.Fatal("Expected no error for EncodeEnvelope, actual: " + e.Error())
+		}
+
+		decoded, e := security.DecodeEnvelope(encoded)
+
+		if e != nil {
+			t.Fatalf("DecodeEnvelope(EncodeEnvelope(%q)) returned error: %s", payload, e.Error())
+		}
+
+		if decoded.Version != envelope.Version || decoded.KeyId != envelope.KeyId ||
+			!bytes.Equal(decoded.Nonce, envelope.Nonce) || !bytes.Equal(decoded.Payload, envelope.Payload) {
+			t.Errorf("DecodeEnvelope(EncodeEnvelope(%q)) == %v, wanted %v", payload, decoded, envelope)
+		}
+	}
+}
+
+func TestDecodeEnvelope_Invalid(t *testing.T) {
+	encoded, _ := security.EncodeEnvelope(security.Envelope{Version: security.ENVELOPE_VERSION,
+		KeyId:   1,
+		Nonce:   []byte("nonce"),
+		Payload: []byte("payload")})
+
+	for i := 0; i < len(encoded); i++ {
+		if _, e := security.DecodeEnvelope(encoded[:i]); e == nil {
+			t.Errorf("Expected error decoding envelope truncated to %d bytes", i)
+		}
+	}
+
+	if _, e := security.DecodeEnvelope(append(encoded, 0x00)); e == nil {
+		t.Error("Expected error decoding envelope with trailing data")
+	}
+
+	wrongVersion := append([]byte{}, encoded...)
+	wrongVersion[0] = security.ENVELOPE_VERSION + 1
+
+	if _, e := security.DecodeEnvelope(wrongVersion); e == nil {
+		t.Error("Expected error decoding envelope with unsupported version")
+	}
+
+	if _, e := security.EncodeEnvelope(security.Envelope{Nonce: make([]byte, 256)}); e == nil {
+		t.Error("Expected error encoding envelope with too long nonce")
+	}
+}
+
+func TestSecurity_SealOpenArbitraryBytes(t *testing.T) {
+	s := new(security.Security)
+
+	for _, payload := range envelopePayloads {
+		sealed, e := s.Seal(payload)
+
+		if e != nil {
+			t.Fatal("Expected no error for Seal, actual: " + e.Error())
+		}
+
+		if len(sealed)%security.SEAL_PADDING_BLOCK != (security.ENVELOPE_HEADER_SIZE+12+16)%security.SEAL_PADDING_BLOCK {
+			t.Errorf("Expected sealed length to be padded, actual: %d for %d bytes", len(sealed), len(payload))
+		}
+
+		result, e := s.Open(sealed)
+
+		if e != nil || !bytes.Equal(result, payload) {
+			t.Errorf("Open(Seal(%q)) == %q, %v", payload, result, e)
+		}
+	}
+
+	sealed, _ := s.Seal([]byte(stringToEncrypt))
+	sealed[1] ^= 0x01
+
+	if _, e := s.Open(sealed); e == nil {
+		t.Error("Expected error opening envelope with changed key id")
+	}
+}
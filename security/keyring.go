@@ -0,0 +1,131 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+	set of pre-shared keys by key id. the primary key is used for sealing new packets,
+	all the keys are accepted when opening packets, the key is selected by the key id
+	in the envelope header. rotating a key without a flag day:
+	1. AddKey on every agent, new key is accepted but not used yet
+	2. SetPrimary on every agent, new key is used for new packets
+	3. RetireKey of the old key once no agent uses it as primary anymore
+	safe for concurrent use, so keys can be changed while agents are running
+*/
+type Keyring struct {
+	mutex   sync.RWMutex
+	primary uint32
+	keys    map[uint32][]byte
+}
+
+// used by securities without keyring, holds DEFAULT_KEY only
+var defaultKeyring, _ = NewKeyring([]byte(DEFAULT_KEY))
+
+// identifies the key. first 4 bytes of sha256 of the key
+func KeyIdOf(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// checks key can be used for aes. key length has to be 16, 24 or 32 bytes
+func checkKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return errors.New("Error: key length has to be 16, 24 or 32 bytes, actual: " + strconv.Itoa(len(key)))
+	}
+}
+
+// creates keyring with primaryKey as the only and primary key
+func NewKeyring(primaryKey []byte) (*Keyring, error) {
+	result := &Keyring{keys: make(map[uint32][]byte)}
+
+	id, e := result.AddKey(primaryKey)
+	if e != nil {
+		return nil, e
+	}
+
+	result.primary = id
+	return result, nil
+}
+
+// adds key that is accepted for opening packets and returns its id
+func (this *Keyring) AddKey(key []byte) (uint32, error) {
+	if e := checkKey(key); e != nil {
+		return 0, e
+	}
+
+	keyCopy := make([]byte, len(key))
+	copy(keyCopy, key)
+	id := KeyIdOf(keyCopy)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.keys[id] = keyCopy
+	return id, nil
+}
+
+// makes key with given id the one used for sealing, the key has to be added first
+func (this *Keyring) SetPrimary(id uint32) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if _, ok := this.keys[id]; !ok {
+		return errors.New("Error: key " + strconv.FormatUint(uint64(id), 16) + " is not in keyring")
+	}
+
+	this.primary = id
+	return nil
+}
+
+// removes key with given id, packets sealed with it will not be opened anymore
+// primary key can not be retired, another key has to be made primary first
+func (this *Keyring) RetireKey(id uint32) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if id == this.primary {
+		return errors.New("Error: primary key " + strconv.FormatUint(uint64(id), 16) + " can not be retired")
+	}
+
+	delete(this.keys, id)
+	return nil
+}
+
+// returns id and value of the key used for sealing
+func (this *Keyring) Primary() (uint32, []byte) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	return this.primary, this.keys[this.primary]
+}
+
+// returns key with given id, if it is in keyring
+func (this *Keyring) Key(id uint32) ([]byte, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	key, ok := this.keys[id]
+	return key, ok
+}
+
+// returns ids of all keys accepted for opening, sorted
+func (this *Keyring) KeyIds() []uint32 {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	result := make([]uint32, 0, len(this.keys))
+	for id := range this.keys {
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
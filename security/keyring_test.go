@@ -0,0 +1,87 @@
+package security_test
+
+import (
+	"github.com/sanitizer/discovery/security"
+	"testing"
+)
+
+var (
+	oldKey = []byte("0123456789abcdef0123456789abcdef")
+	newKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func TestKeyring(t *testing.T) {
+	if _, e := security.NewKeyring([]byte("short")); e == nil {
+		t.Error("Expected error creating keyring with invalid key")
+	}
+
+	keyring, _ := security.NewKeyring(oldKey)
+	oldId := security.KeyIdOf(oldKey)
+
+	if id, key := keyring.Primary(); id != oldId || string(key) != string(oldKey) {
+		t.Errorf("Expected initial key to be primary, actual: %x", id)
+	}
+
+	newId, e := keyring.AddKey(newKey)
+
+	if e != nil || newId == oldId || len(keyring.KeyIds()) != 2 {
+		t.Fatalf("Expected second key to be added, actual ids: %v", keyring.KeyIds())
+	}
+
+	if e := keyring.SetPrimary(12345); e == nil {
+		t.Error("Expected error making unknown key primary")
+	}
+
+	if e := keyring.RetireKey(oldId); e == nil {
+		t.Error("Expected error retiring primary key")
+	}
+
+	keyring.SetPrimary(newId)
+
+	if e := keyring.RetireKey(oldId); e != nil {
+		t.Error("Expected old key to be retired once it is not primary, actual: " + e.Error())
+	}
+
+	if _, ok := keyring.Key(oldId); ok {
+		t.Error("Expected retired key to be removed")
+	}
+}
+
+func TestSecurity_KeyRotation(t *testing.T) {
+	senderKeyring, _ := security.NewKeyring(oldKey)
+	receiverKeyring, _ := security.NewKeyring(oldKey)
+	sender := security.NewSecurityWithKeyring(senderKeyring)
+	receiver := security.NewSecurityWithKeyring(receiverKeyring)
+
+	// receiver already moved on to the new key, sender did not yet
+	newId, _ := receiverKeyring.AddKey(newKey)
+	receiverKeyring.SetPrimary(newId)
+
+	sealed, _ := sender.Seal([]byte(stringToEncrypt))
+
+	if result, e := receiver.Open(sealed); e != nil || string(result) != stringToEncrypt {
+		t.Errorf("Expected packet sealed with old key to be opened during rotation, actual: %q, %v", result, e)
+	}
+
+	token, _ := sender.GenerateDiscoReqToken()
+
+	if !receiver.ValidateDiscoReqToken(token) {
+		t.Error("Expected token made with old key to be accepted during rotation")
+	}
+
+	receiverKeyring.RetireKey(security.KeyIdOf(oldKey))
+
+	if _, e := receiver.Open(sealed); e == nil {
+		t.Error("Expected packet sealed with retired key to be rejected")
+	}
+
+	if receiver.ValidateDiscoReqToken(token) {
+		t.Error("Expected token made with retired key to be rejected")
+	}
+
+	sealed, _ = receiver.Seal([]byte(stringToEncrypt))
+
+	if _, e := sender.Open(sealed); e == nil {
+		t.Error("Expected packet sealed with new key to be rejected by agent that does not know it")
+	}
+}
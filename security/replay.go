@@ -0,0 +1,82 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// size of random part of a package nonce in bytes
+	NONCE_SIZE = 16
+	// number of nonces remembered by the default nonce cache
+	DEFAULT_NONCE_CACHE_SIZE = 4096
+	// how far package timestamp may be from local time
+	DEFAULT_MAX_CLOCK_SKEW = time.Second * 30
+)
+
+// generates random hex encoded nonce for a package
+func NewNonce() (string, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.New("Error generating package nonce: " + err.Error())
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+/*
+remembers nonces of recently received packages, so a captured package can not be replayed.
+cache is bounded, when it is full the oldest nonce is forgotten. nonces only need to be
+remembered for as long as the package timestamp is accepted, so size should cover the
+number of packages expected within the clock skew window.
+safe for concurrent use
+*/
+type NonceCache struct {
+	mutex sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+// creates nonce cache that remembers up to size nonces
+func NewNonceCache(size int) *NonceCache {
+	if size <= 0 {
+		size = DEFAULT_NONCE_CACHE_SIZE
+	}
+	return &NonceCache{seen: make(map[string]struct{}, size), order: make([]string, size)}
+}
+
+// remembers nonce and returns true if it was not seen before
+func (this *NonceCache) Remember(nonce string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if _, ok := this.seen[nonce]; ok {
+		return false
+	}
+
+	// forgetting the oldest nonce when cache is full
+	if oldest := this.order[this.next]; oldest != "" {
+		delete(this.seen, oldest)
+	}
+
+	this.order[this.next] = nonce
+	this.next = (this.next + 1) % len(this.order)
+	this.seen[nonce] = struct{}{}
+	return true
+}
+
+// checks that package timestamp is within maxSkew of now in either direction
+func CheckTimestamp(timestamp int64, now time.Time, maxSkew time.Duration) error {
+	if maxSkew <= 0 {
+		maxSkew = DEFAULT_MAX_CLOCK_SKEW
+	}
+
+	skew := now.Sub(time.Unix(0, timestamp))
+	if skew > maxSkew || skew < -maxSkew {
+		return errors.New("Error: package timestamp is outside of the accepted clock skew window: " + skew.String())
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package security_test
+
+import (
+	"github.com/sanitizer/discovery/security"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewNonce(t *testing.T) {
+	nonce1, e1 := security.NewNonce()
+	nonce2, e2 := security.NewNonce()
+
+	if e1 != nil || e2 != nil || nonce1 == "" || nonce1 == nonce2 {
+		t.Errorf("Expected two different nonces, actual: %q, %q", nonce1, nonce2)
+	}
+}
+
+func TestNonceCache_Remember(t *testing.T) {
+	cache := security.NewNonceCache(3)
+
+	if !cache.Remember("a") || !cache.Remember("b") {
+		t.Error("Expected new nonces to be remembered")
+	}
+
+	if cache.Remember("a") {
+		t.Error("Expected repeated nonce to be rejected")
+	}
+
+	cache.Remember("c")
+	// cache is full, "a" is the oldest and gets forgotten
+	cache.Remember("d")
+
+	if !cache.Remember("a") {
+		t.Error("Expected the oldest nonce to be forgotten when cache is full")
+	}
+
+	if cache.Remember("d") {
+		t.Error("Expected recent nonce to still be remembered")
+	}
+
+	big := security.NewNonceCache(0)
+	for i := 0; i < security.DEFAULT_NONCE_CACHE_SIZE; i++ {
+		big.Remember(strconv.Itoa(i))
+	}
+
+	if big.Remember("0") {
+		t.Error("Expected cache with default size to remember DEFAULT_NONCE_CACHE_SIZE nonces")
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Now()
+
+	if e := security.CheckTimestamp(now.Add(-time.Second).UnixNano(), now, time.Second*5); e != nil {
+		t.Error("Expected timestamp within skew to be accepted, actual: " + e.Error())
+	}
+
+	if e := security.CheckTimestamp(now.Add(-time.Second*10).UnixNano(), now, time.Second*5); e == nil {
+		t.Error("Expected old timestamp to be rejected")
+	}
+
+	if e := security.CheckTimestamp(now.Add(time.Second*10).UnixNano(), now, time.Second*5); e == nil {
+		t.Error("Expected timestamp from the future to be rejected")
+	}
+
+	if e := security.CheckTimestamp(now.Add(-security.DEFAULT_MAX_CLOCK_SKEW/2).UnixNano(), now, 0); e != nil {
+		t.Error("Expected default skew to be used when none is given, actual: " + e.Error())
+	}
+}
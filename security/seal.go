@@ -0,0 +1,187 @@
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"strconv"
+	"time"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+)
+
+// creates AES-GCM aead using the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+// sealed data is padded to a multiple of this size, so its length does not give away the plain text length
+const SEAL_PADDING_BLOCK = 32
+
+// identifies the key used for sealing, see KeyIdOf
+func (this *Security) KeyId() uint32 {
+	id, _ := this.getKeyring().Primary()
+	return id
+}
+
+// prefixes data with its length and pads it up to a multiple of SEAL_PADDING_BLOCK
+func padPlainText(plainText []byte) []byte {
+	length := 4 + len(plainText)
+	length += (SEAL_PADDING_BLOCK - length%SEAL_PADDING_BLOCK) % SEAL_PADDING_BLOCK
+
+	result := make([]byte, length)
+	binary.BigEndian.PutUint32(result, uint32(len(plainText)))
+	copy(result[4:], plainText)
+	return result
+}
+
+// reverts padPlainText
+func unpadPlainText(padded []byte) ([]byte, error) {
+	if len(padded) < 4 || uint64(binary.BigEndian.Uint32(padded)) > uint64(len(padded)-4) {
+		return nil, errors.New("Error: padded data has invalid length")
+	}
+
+	return padded[4 : 4+binary.BigEndian.Uint32(padded)], nil
+}
+
+/*
+	AES-GCM - Galois/Counter Mode,
+	authenticated encryption: besides hiding the data, any change to the sealed data
+	is detected when opening it. a random nonce is generated for every call, so the same
+	plain text never produces the same output.
+	result is an Envelope frame holding key id, nonce and the sealed padded data,
+	version and key id are authenticated together with the data
+*/
+func (this *Security) Seal(plainText []byte) ([]byte, error) {
+	keyId, key := this.getKeyring().Primary()
+	aead, err := newAEAD(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := Envelope{Version: ENVELOPE_VERSION, KeyId: keyId, Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, errors.New("Error generating nonce: " + err.Error())
+	}
+
+	envelope.Payload = aead.Seal(nil, envelope.Nonce, padPlainText(plainText), envelope.authenticatedHeader())
+	return EncodeEnvelope(envelope)
+}
+
+// opens data sealed by Seal. fails if the data was truncated, modified or sealed with a key that is not in keyring
+func (this *Security) Open(sealed []byte) ([]byte, error) {
+	envelope, err := DecodeEnvelope(sealed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := this.getKeyring().Key(envelope.KeyId)
+	if !ok {
+		return nil, errors.New("Error opening sealed data: unknown key id " + strconv.FormatUint(uint64(envelope.KeyId), 16))
+	}
+
+	aead, err := newAEAD(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, errors.New("Error opening sealed data: invalid nonce length")
+	}
+
+	padded, err := aead.Open(nil, envelope.Nonce, envelope.Payload, envelope.authenticatedHeader())
+
+	if err != nil {
+		return nil, errors.New("Error opening sealed data: " + err.Error())
+	}
+
+	return unpadPlainText(padded)
+}
+
+// encodes the whole package and seals it, the result carries only the sealed envelope
+// timestamp and nonce are set on the package, if they were not set by the caller
+// package is signed after that, if security has a signing key
+// sealed package has to fit into discomodel.DISCOVERY_PKG_BUDGET
+func (this *Security) SealDiscoveryPkg(data discomodel.DiscoveryPkg) (discomodel.DiscoveryPkg, error) {
+	data.Sealed = nil
+
+	if data.Timestamp == 0 {
+		data.Timestamp = time.Now().UnixNano()
+	}
+
+	if data.Nonce == "" {
+		nonce, err := NewNonce()
+		if err != nil {
+			return discomodel.DiscoveryPkg{}, err
+		}
+		data.Nonce = nonce
+	}
+
+	if err := this.SignDiscoveryPkg(&data); err != nil {
+		return discomodel.DiscoveryPkg{}, err
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(data); err != nil {
+		return discomodel.DiscoveryPkg{}, errors.New("Error encoding discovery package: " + err.Error())
+	}
+
+	sealed, err := this.Seal(buffer.Bytes())
+
+	if err != nil {
+		return discomodel.DiscoveryPkg{}, err
+	}
+
+	if len(sealed) > discomodel.DISCOVERY_PKG_BUDGET {
+		return discomodel.DiscoveryPkg{}, OverBudgetError{Size: len(sealed)}
+	}
+
+	return discomodel.DiscoveryPkg{Sealed: sealed}, nil
+}
+
+// returned by SealDiscoveryPkg when the sealed package does not fit into discomodel.DISCOVERY_PKG_BUDGET,
+// callers may split the content across several packages
+type OverBudgetError struct {
+	Size int
+}
+
+func (this OverBudgetError) Error() string {
+	return "Error: sealed discovery package is " + strconv.Itoa(this.Size) +
+		" bytes, which is over the budget of " + strconv.Itoa(discomodel.DISCOVERY_PKG_BUDGET) + " bytes"
+}
+
+// opens package sealed by SealDiscoveryPkg and replaces data with the opened package
+// nothing in data is changed when opening fails
+func (this *Security) OpenDiscoveryPkg(data *discomodel.DiscoveryPkg) error {
+	if len(data.Sealed) == 0 {
+		return errors.New("Error: discovery package is not sealed")
+	}
+
+	plainText, err := this.Open(data.Sealed)
+
+	if err != nil {
+		return err
+	}
+
+	opened := discomodel.DiscoveryPkg{}
+	if err := gob.NewDecoder(bytes.NewReader(plainText)).Decode(&opened); err != nil {
+		return errors.New("Error decoding opened discovery package: " + err.Error())
+	}
+
+	opened.Sealed = nil
+	*data = opened
+	return nil
+}
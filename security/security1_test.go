@@ -1,9 +1,13 @@
 package security_test
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/sanitizer/discovery/model"
 	"github.com/sanitizer/discovery/security"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -106,12 +110,182 @@ func TestSecurity_GenerateDiscoReqToken(t *testing.T) {
 		t.Error("Expected result1 == result2, actual result1: " + result1 + ", actual result2: " + result2)
 	}
 
-	s3 := security.Security{SeedValue: discomodel.DEFAULT_SEED_VALUE, Offset: 24 * 3600}
+	s3 := security.Security{SeedValue: discomodel.DEFAULT_SEED_VALUE, Offset: 24 * 3600, LegacyCFB: true}
 	result3, e3 := s3.GenerateDiscoReqToken()
 
+	s4 := security.Security{SeedValue: discomodel.DEFAULT_SEED_VALUE, LegacyCFB: true}
+	result4, e4 := s4.GenerateDiscoReqToken()
+
 	fmt.Println("Generated token3:", result3)
 
-	if result1 == result3 || e3 != nil {
-		t.Error("Expected result1 != result3, actual result1: " + result1 + ", actual result3: " + result3)
+	if result3 == result4 || e3 != nil || e4 != nil {
+		t.Error("Expected legacy tokens a day apart to differ, actual result3: " + result3 + ", actual result4: " + result4)
+	}
+}
+
+func TestSecurity_DiscoReqTokenOffset(t *testing.T) {
+	for _, offset := range []int{3600, -5 * 3600, 24 * 3600} {
+		sender := security.Security{Offset: offset}
+		token, e := sender.GenerateDiscoReqToken()
+
+		receiver := security.Security{}
+		if e != nil || !receiver.ValidateDiscoReqToken(token) {
+			t.Errorf("Expected token of a host with Offset %d to be accepted by a host with Offset 0", offset)
+		}
+	}
+}
+
+func TestNewSecurity(t *testing.T) {
+	_, e := security.NewSecurity([]byte("too short"))
+
+	if e == nil {
+		t.Error("Expected error for NewSecurity with 9 bytes key")
+	}
+
+	s1, e1 := security.NewSecurity([]byte("0123456789abcdef0123456789abcdef"))
+	s2, e2 := security.NewSecurity([]byte("fedcba9876543210fedcba9876543210"))
+
+	if e1 != nil || e2 != nil {
+		t.Fatal("Expected no error for NewSecurity with 32 bytes keys")
+	}
+
+	encrypted1, _ := s1.EncryptCFB([]byte(stringToEncrypt))
+	encrypted2, _ := s2.EncryptCFB([]byte(stringToEncrypt))
+
+	if encrypted1 == encrypted2 || encrypted1 == encryptedString {
+		t.Errorf("Expected different keys to produce different cipher texts, actual: %q, %q", encrypted1, encrypted2)
+	}
+
+	decrypted, _ := s1.DecryptCFB([]byte(encrypted1), len(stringToEncrypt))
+
+	if decrypted != stringToEncrypt {
+		t.Errorf("Decrypt(%q) == %q, wanted %q", encrypted1, decrypted, stringToEncrypt)
+	}
+
+	decrypted, _ = s2.DecryptCFB([]byte(encrypted1), len(stringToEncrypt))
+
+	if decrypted == stringToEncrypt {
+		t.Error("Expected data encrypted with another key not to be decrypted")
+	}
+}
+
+func TestNewSecurityFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "discovery.key")
+	os.WriteFile(path, []byte("0123456789abcdef\n"), 0600)
+
+	s, e := security.NewSecurityFromFile(path)
+
+	if e != nil {
+		t.Fatal("Expected no error for NewSecurityFromFile, actual: " + e.Error())
+	}
+
+	expected, _ := security.NewSecurity([]byte("0123456789abcdef"))
+	result1, _ := s.EncryptCFB([]byte(stringToEncrypt))
+	result2, _ := expected.EncryptCFB([]byte(stringToEncrypt))
+
+	if result1 != result2 {
+		t.Errorf("Expected key from file to match the key without trailing new line, actual: %q, %q", result1, result2)
+	}
+
+	_, e = security.NewSecurityFromFile(filepath.Join(t.TempDir(), "missing.key"))
+
+	if e == nil {
+		t.Error("Expected error for NewSecurityFromFile with missing file")
+	}
+}
+
+func TestNewSecurityFromEnv(t *testing.T) {
+	t.Setenv(security.DEFAULT_KEY_ENV_VARIABLE, "0123456789abcdef")
+
+	if _, e := security.NewSecurityFromEnv(""); e != nil {
+		t.Error("Expected no error for NewSecurityFromEnv, actual: " + e.Error())
+	}
+
+	if _, e := security.NewSecurityFromEnv("DISCOVERY_TEST_MISSING_KEY"); e == nil {
+		t.Error("Expected error for NewSecurityFromEnv with missing variable")
+	}
+}
+
+func TestSecurity_SealOpen(t *testing.T) {
+	s := new(security.Security)
+	sealed1, e1 := s.Seal([]byte(stringToEncrypt))
+	sealed2, e2 := s.Seal([]byte(stringToEncrypt))
+
+	if e1 != nil || e2 != nil {
+		t.Fatal("Expected no error for Seal")
+	}
+
+	if bytes.Equal(sealed1, sealed2) {
+		t.Error("Expected every Seal call to use a new nonce")
+	}
+
+	result, e := s.Open(sealed1)
+
+	if e != nil || string(result) != stringToEncrypt {
+		t.Errorf("Open(Seal(%q)) == %q, %v", stringToEncrypt, result, e)
+	}
+
+	tampered := append([]byte{}, sealed1...)
+	tampered[len(tampered)-1] ^= 0x01
+
+	if _, e := s.Open(tampered); e == nil {
+		t.Error("Expected error opening tampered data")
+	}
+
+	if _, e := s.Open(sealed1[:len(sealed1)-1]); e == nil {
+		t.Error("Expected error opening truncated data")
+	}
+
+	if _, e := s.Open(sealed1[:4]); e == nil {
+		t.Error("Expected error opening data shorter than nonce")
+	}
+
+	other, _ := security.NewSecurity([]byte("0123456789abcdef"))
+
+	if _, e := other.Open(sealed1); e == nil {
+		t.Error("Expected error opening data sealed with another key")
+	}
+}
+
+func TestSecurity_SealDiscoveryPkg(t *testing.T) {
+	s := new(security.Security)
+	pkg := discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE,
+		PkgValidation: "token",
+		AppServerIp:   "10.1.2.3",
+		AppServerPort: "8080",
+		Alias:         "host",
+		Timestamp:     1,
+		Nonce:         "nonce"}
+
+	sealed, e := s.SealDiscoveryPkg(pkg)
+
+	if e != nil {
+		t.Fatal("Expected no error for SealDiscoveryPkg, actual: " + e.Error())
+	}
+
+	if sealed.Type != 0 || sealed.AppServerIp != "" || len(sealed.Sealed) == 0 {
+		t.Errorf("Expected sealed package to carry only sealed data, actual: %v", sealed.String())
+	}
+
+	if e := s.OpenDiscoveryPkg(&sealed); e != nil || !reflect.DeepEqual(sealed, pkg) {
+		t.Errorf("OpenDiscoveryPkg(SealDiscoveryPkg(pkg)) == %v, %v", sealed.String(), e)
+	}
+
+	tampered, _ := s.SealDiscoveryPkg(pkg)
+	tampered.Sealed[len(tampered.Sealed)/2] ^= 0x01
+
+	if e := s.OpenDiscoveryPkg(&tampered); e == nil || tampered.Type != 0 {
+		t.Error("Expected tampered package to be rejected and left untouched")
+	}
+
+	if e := s.OpenDiscoveryPkg(&pkg); e == nil {
+		t.Error("Expected error opening package that is not sealed")
+	}
+
+	stamped, _ := s.SealDiscoveryPkg(discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_REQUEST})
+	s.OpenDiscoveryPkg(&stamped)
+
+	if stamped.Timestamp == 0 || stamped.Nonce == "" {
+		t.Errorf("Expected timestamp and nonce to be set on sealed package, actual: %v", stamped.String())
 	}
 }
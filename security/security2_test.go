@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"github.com/sanitizer/discovery/model"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSecurity_generateDiscoReqTokenSeed(t *testing.T) {
@@ -34,3 +36,56 @@ func TestSecurity_generateDiscoReqTokenSeed(t *testing.T) {
 		t.Error("Expected result1 != result2, actual result1: " + strconv.Itoa(int(result1)) + ", actual result3: " + strconv.Itoa(int(result3)))
 	}
 }
+
+func TestSecurity_validateDiscoReqTokenAt(t *testing.T) {
+	s := Security{}
+	now := time.Now()
+	token := generateDiscoReqTokenForStep(s.getKey(), tokenTimeStep(now))
+
+	for _, shift := range []time.Duration{-TOKEN_TIME_STEP, 0, TOKEN_TIME_STEP} {
+		if !s.validateDiscoReqTokenAt(token, now.Add(shift)) {
+			t.Errorf("Expected token to be accepted with clock shifted by %s", shift)
+		}
+	}
+
+	for _, shift := range []time.Duration{-TOKEN_TIME_STEP * 2, TOKEN_TIME_STEP * 2} {
+		if s.validateDiscoReqTokenAt(token, now.Add(shift)) {
+			t.Errorf("Expected token to be rejected with clock shifted by %s", shift)
+		}
+	}
+
+	// hosts on different sides of midnight agree on the token
+	midnight := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	beforeMidnight := generateDiscoReqTokenForStep(s.getKey(), tokenTimeStep(midnight.Add(-time.Second)))
+
+	if !s.validateDiscoReqTokenAt(beforeMidnight, midnight.Add(time.Second)) {
+		t.Error("Expected token generated before midnight to be accepted after midnight")
+	}
+
+	other, _ := NewSecurity([]byte("0123456789abcdef"))
+
+	if other.validateDiscoReqTokenAt(token, now) {
+		t.Error("Expected token generated with another key to be rejected")
+	}
+
+	if s.validateDiscoReqTokenAt("", now) {
+		t.Error("Expected empty token to be rejected")
+	}
+}
+
+func TestSecurity_generateLegacyDiscoReqTokenConcurrent(t *testing.T) {
+	s := &Security{LegacyCFB: true}
+	expected, _ := s.generateLegacyDiscoReqToken()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result, _ := s.GenerateDiscoReqToken(); result != expected {
+				t.Errorf("Expected concurrent legacy tokens to be equal, actual: %q, %q", result, expected)
+			}
+		}()
+	}
+	wg.Wait()
+}
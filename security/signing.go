@@ -0,0 +1,100 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	// gitlab apis
+	"github.com/sanitizer/discovery/model"
+)
+
+// number of sha256 bytes of public key used as its id
+const SIGNING_KEY_ID_SIZE = 8
+
+/*
+	public keys of agents whose discovery packages are trusted, by key id.
+	not safe for changes while in use by a handler, build it before starting the server
+*/
+type TrustedKeys map[string]ed25519.PublicKey
+
+// creates trusted keys set holding given keys
+func NewTrustedKeys(keys ...ed25519.PublicKey) TrustedKeys {
+	result := make(TrustedKeys)
+	for _, key := range keys {
+		result.Add(key)
+	}
+	return result
+}
+
+// adds key to the set and returns its id
+func (this TrustedKeys) Add(key ed25519.PublicKey) string {
+	id := SigningKeyId(key)
+	this[id] = key
+	return id
+}
+
+// hex encoded first SIGNING_KEY_ID_SIZE bytes of sha256 of the public key
+func SigningKeyId(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:SIGNING_KEY_ID_SIZE])
+}
+
+// generates new ed25519 keypair for signing discovery packages
+func GenerateSigningKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// parses hex encoded ed25519 public key, e.g. from a config file
+func ParseTrustedKey(hexKey string) (ed25519.PublicKey, error) {
+	key, e := hex.DecodeString(hexKey)
+	if e != nil {
+		return nil, errors.New("Error decoding trusted key: " + e.Error())
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("Error: trusted key length has to be " + strconv.Itoa(ed25519.PublicKeySize) + " bytes, actual: " + strconv.Itoa(len(key)))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// signs package with SigningKey of security, does nothing if SigningKey is not set
+func (this *Security) SignDiscoveryPkg(data *discomodel.DiscoveryPkg) error {
+	if this.SigningKey == nil {
+		return nil
+	}
+
+	if len(this.SigningKey) != ed25519.PrivateKeySize {
+		return errors.New("Error: signing key length has to be " + strconv.Itoa(ed25519.PrivateKeySize) + " bytes")
+	}
+
+	data.SignerKeyId = SigningKeyId(this.SigningKey.Public().(ed25519.PublicKey))
+	data.Signature = ed25519.Sign(this.SigningKey, data.SignedContent())
+	return nil
+}
+
+/*
+	checks that package was signed by one of TrustedKeys.
+	if security has no trusted keys, signatures are not required and every package passes
+*/
+func (this *Security) VerifyDiscoveryPkg(data *discomodel.DiscoveryPkg) error {
+	if len(this.TrustedKeys) == 0 {
+		return nil
+	}
+
+	if len(data.Signature) == 0 {
+		return errors.New("Error: discovery package is not signed")
+	}
+
+	key, ok := this.TrustedKeys[data.SignerKeyId]
+	if !ok {
+		return errors.New("Error: discovery package signer " + strconv.Quote(data.SignerKeyId) + " is not trusted")
+	}
+
+	if !ed25519.Verify(key, data.SignedContent(), data.Signature) {
+		return errors.New("Error: discovery package signature is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package security_test
+
+import (
+	"encoding/hex"
+	"github.com/sanitizer/discovery/model"
+	"github.com/sanitizer/discovery/security"
+	"testing"
+)
+
+func TestSecurity_SignVerifyDiscoveryPkg(t *testing.T) {
+	trustedPublic, trustedPrivate, _ := security.GenerateSigningKey()
+	otherPublic, otherPrivate, _ := security.GenerateSigningKey()
+
+	signer := &security.Security{SigningKey: trustedPrivate}
+	verifier := &security.Security{TrustedKeys: security.NewTrustedKeys(trustedPublic)}
+
+	pkg := discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE, AppServerIp: "10.1.2.3", AppServerPort: "5432"}
+	signer.SignDiscoveryPkg(&pkg)
+
+	if pkg.SignerKeyId != security.SigningKeyId(trustedPublic) || len(pkg.Signature) == 0 {
+		t.Fatalf("Expected package to be signed, actual: %v", pkg.String())
+	}
+
+	if e := verifier.VerifyDiscoveryPkg(&pkg); e != nil {
+		t.Error("Expected package signed by trusted key to be verified, actual: " + e.Error())
+	}
+
+	tampered := pkg
+	tampered.AppServerIp = "10.6.6.6"
+
+	if e := verifier.VerifyDiscoveryPkg(&tampered); e == nil {
+		t.Error("Expected package with changed server ip to be rejected")
+	}
+
+	untrusted := discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE, AppServerIp: "10.1.2.3", AppServerPort: "5432"}
+	(&security.Security{SigningKey: otherPrivate}).SignDiscoveryPkg(&untrusted)
+
+	if e := verifier.VerifyDiscoveryPkg(&untrusted); e == nil {
+		t.Error("Expected package signed by untrusted key to be rejected")
+	}
+
+	// claiming to be the trusted signer does not help without its private key
+	untrusted.SignerKeyId = security.SigningKeyId(trustedPublic)
+
+	if e := verifier.VerifyDiscoveryPkg(&untrusted); e == nil {
+		t.Error("Expected package with forged signer key id to be rejected")
+	}
+
+	unsigned := discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE}
+
+	if e := verifier.VerifyDiscoveryPkg(&unsigned); e == nil {
+		t.Error("Expected unsigned package to be rejected when trusted keys are set")
+	}
+
+	if e := new(security.Security).VerifyDiscoveryPkg(&unsigned); e != nil {
+		t.Error("Expected unsigned package to pass when no trusted keys are set, actual: " + e.Error())
+	}
+
+	if _, e := security.ParseTrustedKey(hex.EncodeToString(otherPublic)); e != nil {
+		t.Error("Expected hex encoded public key to be parsed, actual: " + e.Error())
+	}
+
+	if _, e := security.ParseTrustedKey("abcd"); e == nil {
+		t.Error("Expected error parsing too short public key")
+	}
+}
+
+func TestSecurity_SealSignedDiscoveryPkg(t *testing.T) {
+	public, private, _ := security.GenerateSigningKey()
+	signer := &security.Security{SigningKey: private}
+	verifier := &security.Security{TrustedKeys: security.NewTrustedKeys(public)}
+
+	sealed, e := signer.SealDiscoveryPkg(discomodel.DiscoveryPkg{Type: discomodel.DISCOVERY_PACKAGE,
+		Attributes: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}})
+	if e != nil {
+		t.Fatal("Expected no error sealing signed package, actual: " + e.Error())
+	}
+
+	if e := verifier.OpenDiscoveryPkg(&sealed); e != nil {
+		t.Fatal("Expected no error opening signed package, actual: " + e.Error())
+	}
+
+	// timestamp and nonce are set before signing, so they are covered by signature
+	if e := verifier.VerifyDiscoveryPkg(&sealed); e != nil || sealed.Nonce == "" {
+		t.Errorf("Expected sealed package to be signed after stamping, actual: %v", e)
+	}
+}
@@ -0,0 +1,79 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// validity period of a discovery request token
+	TOKEN_TIME_STEP = time.Minute
+	// number of neighbouring time steps accepted on each side of the current one
+	TOKEN_ACCEPTED_STEPS = 1
+	// number of hmac bytes kept in the token
+	TOKEN_SIZE = 16
+)
+
+// separates token hmac from any other use of the key
+var tokenDomain = []byte("discovery request token")
+
+// time step for the given time, unix time does not depend on any time zone, so Offset is not used here
+func tokenTimeStep(now time.Time) int64 {
+	return now.Unix() / int64(TOKEN_TIME_STEP/time.Second)
+}
+
+// hex encoded hmac-sha256 of the key over the time step
+func generateDiscoReqTokenForStep(key []byte, step int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(tokenDomain)
+	binary.Write(mac, binary.BigEndian, step)
+	return hex.EncodeToString(mac.Sum(nil)[:TOKEN_SIZE])
+}
+
+/*
+	TOTP like token: hmac of the pre-shared key over the current time step of TOKEN_TIME_STEP.
+	only agents knowing the key can produce it and it does not depend on any time zone or date,
+	so agents on both sides of midnight or with different Offset still agree on it.
+	in LegacyCFB mode the old date based token is returned to stay compatible with old agents
+*/
+func (this *Security) GenerateDiscoReqToken() (string, error) {
+	if this.LegacyCFB {
+		return this.generateLegacyDiscoReqToken()
+	}
+	return generateDiscoReqTokenForStep(this.getKey(), tokenTimeStep(time.Now())), nil
+}
+
+// checks token generated by GenerateDiscoReqToken, tokens of TOKEN_ACCEPTED_STEPS
+// previous and next time steps are accepted as well to tolerate clock skew.
+// tokens made with any key of the keyring are accepted, so agents still using the old
+// primary key during key rotation are not rejected
+func (this *Security) ValidateDiscoReqToken(token string) bool {
+	if this.LegacyCFB {
+		expected, e := this.generateLegacyDiscoReqToken()
+		return e == nil && hmac.Equal([]byte(expected), []byte(token))
+	}
+	return this.validateDiscoReqTokenAt(token, time.Now())
+}
+
+func (this *Security) validateDiscoReqTokenAt(token string, now time.Time) bool {
+	keyring := this.getKeyring()
+	step := tokenTimeStep(now)
+	valid := false
+	for _, id := range keyring.KeyIds() {
+		key, ok := keyring.Key(id)
+		if !ok {
+			continue
+		}
+
+		for i := step - TOKEN_ACCEPTED_STEPS; i <= step+TOKEN_ACCEPTED_STEPS; i++ {
+			// checking all the steps, so time spent does not tell which step matched
+			if hmac.Equal([]byte(generateDiscoReqTokenForStep(key, i)), []byte(token)) {
+				valid = true
+			}
+		}
+	}
+	return valid
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+// directed broadcast address of ipv4 subnet, e.g. 10.1.2.255 for 10.1.2.3/24
+// false for ipv6 and for subnets without broadcast address (/31 and /32)
+func DirectedBroadcastIp(ipNet *net.IPNet) (net.IP, bool) {
+	ip := ipNet.IP.To4()
+	ones, bits := ipNet.Mask.Size()
+	if ip == nil || bits != 32 || ones >= 31 {
+		return nil, false
+	}
+
+	mask := net.IP(ipNet.Mask).To4()
+	result := make(net.IP, net.IPv4len)
+	for i := range ip {
+		result[i] = ip[i] | ^mask[i]
+	}
+	return result, true
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ returns directed broadcast addresses of the subnets of all the up, broadcast capable,
+ non loopback interfaces.
+ include - names of the interfaces to use, empty means all of them
+ exclude - names of the interfaces to skip, e.g. docker0
+*/
+func DirectedBroadcastIps(include []string, exclude []string) ([]string, error) {
+	interfaces, e := net.Interfaces()
+	if e != nil {
+		return nil, errors.New("Error listing interfaces: " + e.Error())
+	}
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagBroadcast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		if (len(include) > 0 && !containsName(include, ifi.Name)) || containsName(exclude, ifi.Name) {
+			continue
+		}
+
+		addresses, e := ifi.Addrs()
+		if e != nil {
+			continue
+		}
+
+		for _, address := range addresses {
+			ipNet, ok := address.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if broadcastIp, ok := DirectedBroadcastIp(ipNet); ok && !seen[broadcastIp.String()] {
+				seen[broadcastIp.String()] = true
+				result = append(result, broadcastIp.String())
+			}
+		}
+	}
+
+	return result, nil
+}
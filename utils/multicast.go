@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+// default multicast ttl, packets do not leave the local network
+const DEFAULT_MULTICAST_TTL = 1
+
+// resolves interfaces by name, no names means the interface chosen by the system (nil)
+func MulticastInterfaces(names []string) ([]*net.Interface, error) {
+	if len(names) == 0 {
+		return []*net.Interface{nil}, nil
+	}
+
+	result := make([]*net.Interface, 0, len(names))
+	for _, name := range names {
+		ifi, e := net.InterfaceByName(name)
+		if e != nil {
+			return nil, errors.New("Error finding interface " + name + ": " + e.Error())
+		}
+		result = append(result, ifi)
+	}
+	return result, nil
+}
+
+// returns all the up, non loopback interfaces supporting multicast
+func UpMulticastInterfaces() ([]*net.Interface, error) {
+	interfaces, e := net.Interfaces()
+	if e != nil {
+		return nil, errors.New("Error listing interfaces: " + e.Error())
+	}
+
+	result := make([]*net.Interface, 0)
+	for i := range interfaces {
+		flags := interfaces[i].Flags
+		if flags&net.FlagUp != 0 && flags&net.FlagMulticast != 0 && flags&net.FlagLoopback == 0 {
+			result = append(result, &interfaces[i])
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("Error: no up multicast interface was found")
+	}
+	return result, nil
+}
+
+// returns first ipv4 address of interface, zero address for nil interface
+func interfaceIPv4(ifi *net.Interface) ([4]byte, error) {
+	var result [4]byte
+	if ifi == nil {
+		return result, nil
+	}
+
+	addresses, e := ifi.Addrs()
+	if e != nil {
+		return result, errors.New("Error reading addresses of interface " + ifi.Name + ": " + e.Error())
+	}
+
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			copy(result[:], ipNet.IP.To4())
+			return result, nil
+		}
+	}
+	return result, errors.New("Error: interface " + ifi.Name + " has no ipv4 address")
+}
+
+// runs fn on the socket of connection and returns the error of fn
+func controlSocket(connection *net.UDPConn, fn func(fd uintptr) error) error {
+	rawConnection, e := connection.SyscallConn()
+	if e != nil {
+		return e
+	}
+
+	var fnErr error
+	if e := rawConnection.Control(func(fd uintptr) { fnErr = fn(fd) }); e != nil {
+		return e
+	}
+	return fnErr
+}
+
+// same as SetMulticastSendOptions for a socket connected to the multicast group
+func SetMulticastOptions(connection *net.UDPConn, ifi *net.Interface, ttl int, loopback bool) error {
+	group := net.IPv4zero
+	if remote, ok := connection.RemoteAddr().(*net.UDPAddr); ok {
+		group = remote.IP
+	}
+	return SetMulticastSendOptions(connection, group, ifi, ttl, loopback)
+}
+
+/*
+ sets options of a socket sending to an ipv4 or ipv6 multicast group:
+ group - decides whether ipv4 or ipv6 options are set
+ ifi - interface packets are sent from, nil keeps the one chosen by the system
+ ttl - number of hops packets may take, 0 means DEFAULT_MULTICAST_TTL
+ loopback - whether packets are delivered to listeners on the sending host
+*/
+func SetMulticastSendOptions(connection *net.UDPConn, group net.IP, ifi *net.Interface, ttl int, loopback bool) error {
+	if ttl <= 0 {
+		ttl = DEFAULT_MULTICAST_TTL
+	}
+
+	if group.To4() == nil {
+		return setMulticastOptions6(connection, ifi, ttl, loopback)
+	}
+
+	address, e := interfaceIPv4(ifi)
+	if e != nil {
+		return e
+	}
+
+	return controlSocket(connection, func(fd uintptr) error {
+		if ifi != nil {
+			if e := setMulticastInterface(fd, address); e != nil {
+				return errors.New("Error setting multicast interface: " + e.Error())
+			}
+		}
+
+		if e := setMulticastTtl(fd, ttl); e != nil {
+			return errors.New("Error setting multicast ttl: " + e.Error())
+		}
+
+		if e := setMulticastLoopback(fd, loopback); e != nil {
+			return errors.New("Error setting multicast loopback: " + e.Error())
+		}
+		return nil
+	})
+}
+
+// same as SetMulticastSendOptions for ipv6, ttl is the hop limit
+func setMulticastOptions6(connection *net.UDPConn, ifi *net.Interface, hops int, loopback bool) error {
+	return controlSocket(connection, func(fd uintptr) error {
+		if ifi != nil {
+			if e := setMulticastInterface6(fd, ifi.Index); e != nil {
+				return errors.New("Error setting multicast interface: " + e.Error())
+			}
+		}
+
+		if e := setMulticastHops6(fd, hops); e != nil {
+			return errors.New("Error setting multicast hop limit: " + e.Error())
+		}
+
+		if e := setMulticastLoopback6(fd, loopback); e != nil {
+			return errors.New("Error setting multicast loopback: " + e.Error())
+		}
+		return nil
+	})
+}
+
+// joins ipv4 or ipv6 multicast group on interface, in addition to the groups connection already joined
+func JoinMulticastGroup(connection *net.UDPConn, group net.IP, ifi *net.Interface) error {
+	if !group.IsMulticast() {
+		return errors.New("Error: " + group.String() + " is not a multicast group")
+	}
+
+	if group.To4() == nil {
+		var groupAddress [16]byte
+		copy(groupAddress[:], group.To16())
+
+		index := 0
+		if ifi != nil {
+			index = ifi.Index
+		}
+
+		return controlSocket(connection, func(fd uintptr) error {
+			if e := joinMulticastGroup6(fd, groupAddress, index); e != nil {
+				return errors.New("Error joining multicast group " + group.String() + ": " + e.Error())
+			}
+			return nil
+		})
+	}
+
+	address, e := interfaceIPv4(ifi)
+	if e != nil {
+		return e
+	}
+
+	var groupAddress [4]byte
+	copy(groupAddress[:], group.To4())
+
+	return controlSocket(connection, func(fd uintptr) error {
+		if e := joinMulticastGroup(fd, groupAddress, address); e != nil {
+			return errors.New("Error joining multicast group " + group.String() + ": " + e.Error())
+		}
+		return nil
+	})
+}
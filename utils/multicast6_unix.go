@@ -0,0 +1,28 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package utils
+
+import "syscall"
+
+// ipv6 multicast options take an int on every unix, interface is given by its index
+
+func setMulticastInterface6(fd uintptr, index int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, index)
+}
+
+func setMulticastHops6(fd uintptr, hops int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, hops)
+}
+
+func setMulticastLoopback6(fd uintptr, loopback bool) error {
+	value := 0
+	if loopback {
+		value = 1
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, value)
+}
+
+func joinMulticastGroup6(fd uintptr, group [16]byte, index int) error {
+	return syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP,
+		&syscall.IPv6Mreq{Multiaddr: group, Interface: uint32(index)})
+}
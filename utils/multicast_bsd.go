@@ -0,0 +1,28 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package utils
+
+import "syscall"
+
+// bsd sockets take ttl and loopback of ipv4 multicast as a single byte
+
+func setMulticastInterface(fd uintptr, address [4]byte) error {
+	return syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, address)
+}
+
+func setMulticastTtl(fd uintptr, ttl int) error {
+	return syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl))
+}
+
+func setMulticastLoopback(fd uintptr, loopback bool) error {
+	var value byte
+	if loopback {
+		value = 1
+	}
+	return syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, value)
+}
+
+func joinMulticastGroup(fd uintptr, group [4]byte, address [4]byte) error {
+	return syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP,
+		&syscall.IPMreq{Multiaddr: group, Interface: address})
+}
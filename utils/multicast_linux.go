@@ -0,0 +1,26 @@
+//go:build linux
+
+package utils
+
+import "syscall"
+
+func setMulticastInterface(fd uintptr, address [4]byte) error {
+	return syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, address)
+}
+
+func setMulticastTtl(fd uintptr, ttl int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+}
+
+func setMulticastLoopback(fd uintptr, loopback bool) error {
+	value := 0
+	if loopback {
+		value = 1
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, value)
+}
+
+func joinMulticastGroup(fd uintptr, group [4]byte, address [4]byte) error {
+	return syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP,
+		&syscall.IPMreq{Multiaddr: group, Interface: address})
+}
@@ -0,0 +1,52 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package utils
+
+import "errors"
+
+// system defaults (ttl 1, loopback on) are accepted, as they need no socket option
+var errMulticastOptions = errors.New("Error: multicast socket options are not supported on this platform")
+
+func setMulticastInterface(fd uintptr, address [4]byte) error {
+	return errMulticastOptions
+}
+
+func setMulticastTtl(fd uintptr, ttl int) error {
+	if ttl == DEFAULT_MULTICAST_TTL {
+		return nil
+	}
+	return errMulticastOptions
+}
+
+func setMulticastLoopback(fd uintptr, loopback bool) error {
+	if loopback {
+		return nil
+	}
+	return errMulticastOptions
+}
+
+func joinMulticastGroup(fd uintptr, group [4]byte, address [4]byte) error {
+	return errMulticastOptions
+}
+
+func setMulticastInterface6(fd uintptr, index int) error {
+	return errMulticastOptions
+}
+
+func setMulticastHops6(fd uintptr, hops int) error {
+	if hops == DEFAULT_MULTICAST_TTL {
+		return nil
+	}
+	return errMulticastOptions
+}
+
+func setMulticastLoopback6(fd uintptr, loopback bool) error {
+	if loopback {
+		return nil
+	}
+	return errMulticastOptions
+}
+
+func joinMulticastGroup6(fd uintptr, group [16]byte, index int) error {
+	return errMulticastOptions
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"net"
 	"os"
@@ -14,14 +15,22 @@ const (
 	DIAL_TIMEOUT = time.Second * 3
 )
 
-// concats host and port by ':' separator
+// concats host and port by ':' separator, ipv6 hosts (with zone, e.g. fe80::1%eth0) are put in brackets
 func GetConnectionString(host string, port string) string {
-	return strings.Join([]string{host, port}, ":")
+	return net.JoinHostPort(host, port)
 }
 
 // method will try to see if the connection is reachable
 func ConnectionIsLive(conType string, ip string, port string) bool {
-	connection, err := net.DialTimeout(conType, GetConnectionString(ip, port), DIAL_TIMEOUT)
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	return ConnectionIsLiveContext(ctx, conType, ip, port)
+}
+
+// same as ConnectionIsLive, but gives up when ctx is done
+func ConnectionIsLiveContext(ctx context.Context, conType string, ip string, port string) bool {
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, conType, GetConnectionString(ip, port))
 
 	if err != nil {
 		return false
@@ -42,6 +51,125 @@ func GetLocalIpUsingLookup() (string, error) {
 	return "", errors.New("Error finding local ip for the localhost using net.LookupIp")
 }
 
+// same as GetLocalIpUsingLookup for ipv6. link local addresses are skipped, as they need a zone
+func GetLocalIpv6UsingLookup() (string, error) {
+	host, _ := os.Hostname()
+	addresses, _ := net.LookupIP(host)
+	for _, address := range addresses {
+		if address.To4() == nil && !address.IsLoopback() && !address.IsLinkLocalUnicast() {
+			return address.String(), nil
+		}
+	}
+	return "", errors.New("Error finding local ipv6 for the localhost using net.LookupIp")
+}
+
+/*
+ returns up to max addresses of the other ip family on the up interface holding ip, e.g. the
+ ipv6 addresses of a dual-stack interface next to its ipv4 ip, see OtherFamilyIps.
+ none when no interface holds ip
+*/
+func GetOtherFamilyIps(ip string, max int) ([]string, error) {
+	interfaces, e := net.Interfaces()
+	if e != nil {
+		return nil, errors.New("Error listing interfaces: " + e.Error())
+	}
+
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addresses, e := ifi.Addrs()
+		if e != nil {
+			continue
+		}
+
+		if result, ok := OtherFamilyIps(ip, addresses, max); ok {
+			return result, nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+ returns up to max addresses of the other ip family than ip out of the addresses of one interface,
+ false when ip is not one of them. global addresses come before link local ones.
+ zones are left out, as the zone of a link local address names an interface of this host only
+*/
+func OtherFamilyIps(ip string, addresses []net.Addr, max int) ([]string, bool) {
+	host, _ := splitZone(ip)
+	parsed := net.ParseIP(host)
+	if parsed == nil {
+		return nil, false
+	}
+
+	holdsIp := false
+	global := make([]string, 0)
+	linkLocal := make([]string, 0)
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipNet.IP.Equal(parsed) {
+			holdsIp = true
+		} else if (ipNet.IP.To4() == nil) == (parsed.To4() == nil) {
+			continue
+		} else if ipNet.IP.IsLinkLocalUnicast() {
+			linkLocal = append(linkLocal, ipNet.IP.String())
+		} else {
+			global = append(global, ipNet.IP.String())
+		}
+	}
+
+	if !holdsIp {
+		return nil, false
+	}
+
+	result := append(global, linkLocal...)
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result, true
+}
+
+// returns address without its zone, e.g. fe80::1 for fe80::1%eth0
+func StripZone(address string) string {
+	host, _ := splitZone(address)
+	return host
+}
+
+// adds zone to link local ipv6 address that has none, any other address is returned as it is
+func WithZone(address string, zone string) string {
+	ip := net.ParseIP(address)
+	if zone == "" || ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return address
+	}
+	return address + "%" + zone
+}
+
+// compares ip addresses ignoring their text form, e.g. ::1 and 0:0:0:0:0:0:0:1 are the same
+// addresses that can not be parsed are compared as strings
+func SameIp(a string, b string) bool {
+	hostA, zoneA := splitZone(a)
+	hostB, zoneB := splitZone(b)
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB) && zoneA == zoneB
+}
+
+// splits ipv6 zone from address, e.g. fe80::1%eth0
+func splitZone(address string) (string, string) {
+	if i := strings.LastIndex(address, "%"); i >= 0 {
+		return address[:i], address[i+1:]
+	}
+	return address, ""
+}
+
 func GetIpUsingIpify() (string, error) {
 	return ipify.GetIp()
 }
@@ -2,8 +2,10 @@ package utils_test
 
 import (
 	"fmt"
+	"net"
 	"github.com/sanitizer/discovery/utils"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +26,80 @@ func TestConnectionIsLive(t *testing.T) {
 		t.Errorf("ConnectionIsLive(tcp, 1, 2) == %q, wanted: false", strconv.FormatBool(result))
 	}
 }
+
+func TestGetConnectionString_Ipv6(t *testing.T) {
+	for host, expected := range map[string]string{"::1": "[::1]:1", "fe80::1%eth0": "[fe80::1%eth0]:1", "": ":1"} {
+		if result := utils.GetConnectionString(host, "1"); result != expected {
+			t.Errorf("GetConnectionString(%q, 1) == %q, wanted %q", host, result, expected)
+		}
+	}
+}
+
+func TestSameIp(t *testing.T) {
+	if !utils.SameIp("::1", "0:0:0:0:0:0:0:1") || !utils.SameIp("10.1.2.3", "10.1.2.3") {
+		t.Error("Expected the same addresses in different text form to be the same")
+	}
+
+	if utils.SameIp("fe80::1%eth0", "fe80::1%eth1") || utils.SameIp("10.1.2.3", "10.1.2.4") {
+		t.Error("Expected addresses with different ip or zone to differ")
+	}
+}
+
+func TestDirectedBroadcastIp(t *testing.T) {
+	for cidr, expected := range map[string]string{"10.1.2.3/24": "10.1.2.255", "172.17.0.1/16": "172.17.255.255", "192.168.1.10/30": "192.168.1.11"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		if result, ok := utils.DirectedBroadcastIp(ipNet); !ok || result.String() != expected {
+			t.Errorf("DirectedBroadcastIp(%s) == %v, wanted %s", cidr, result, expected)
+		}
+	}
+
+	for _, cidr := range []string{"10.1.2.3/32", "10.1.2.3/31", "fd00::1/64"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		if result, ok := utils.DirectedBroadcastIp(ipNet); ok {
+			t.Errorf("DirectedBroadcastIp(%s) == %v, wanted no broadcast address", cidr, result)
+		}
+	}
+}
+
+func TestOtherFamilyIps(t *testing.T) {
+	// docker host like interface with many addresses, link local ones carry zones
+	addresses := []net.Addr{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("10.1.3.3"), Mask: net.CIDRMask(24, 32)}}
+	for i := 1; i <= 30; i++ {
+		addresses = append(addresses, &net.IPNet{IP: net.ParseIP("fe80::" + strconv.Itoa(i)), Mask: net.CIDRMask(64, 128)})
+	}
+	addresses = append(addresses, &net.IPNet{IP: net.ParseIP("fd00::5"), Mask: net.CIDRMask(64, 128)})
+
+	result, ok := utils.OtherFamilyIps("10.1.2.3", addresses, 4)
+	if !ok || len(result) != 4 || result[0] != "fd00::5" || result[1] != "fe80::1" {
+		t.Errorf("OtherFamilyIps(10.1.2.3) == %v, %t, wanted 4 ipv6 addresses, global one first", result, ok)
+	}
+
+	for _, ip := range result {
+		if strings.Contains(ip, "%") {
+			t.Errorf("Expected no zone in %q", ip)
+		}
+	}
+
+	if result, ok := utils.OtherFamilyIps("fd00::5", addresses, 4); !ok || len(result) != 2 || result[0] != "10.1.2.3" {
+		t.Errorf("OtherFamilyIps(fd00::5) == %v, %t, wanted both ipv4 addresses", result, ok)
+	}
+
+	if result, ok := utils.OtherFamilyIps("10.9.9.9", addresses, 4); ok || len(result) != 0 {
+		t.Errorf("OtherFamilyIps(10.9.9.9) == %v, %t, wanted none for an ip of another interface", result, ok)
+	}
+}
+
+func TestWithZone(t *testing.T) {
+	for address, expected := range map[string]string{"fe80::1": "fe80::1%eth7", "fe80::1%eth0": "fe80::1%eth0",
+		"fd00::5": "fd00::5", "10.1.2.3": "10.1.2.3"} {
+
+		if result := utils.WithZone(address, "eth7"); result != expected {
+			t.Errorf("WithZone(%q, eth7) == %q, wanted %q", address, result, expected)
+		}
+	}
+
+	if result := utils.StripZone("fe80::1%eth0"); result != "fe80::1" {
+		t.Errorf("StripZone(fe80::1%%eth0) == %q, wanted fe80::1", result)
+	}
+}